@@ -0,0 +1,218 @@
+package sparkypmtatracking
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SinkArchive is the name of the archive event sink
+const SinkArchive = "archive"
+
+// Archive files are named for the UTC day of the events they hold, e.g. events-2020-01-07.ndjson.gz
+const (
+	archivePrefix     = "events-"
+	archiveSuffix     = ".ndjson.gz"
+	archiveDateLayout = "2006-01-02"
+)
+
+// ArchiveSink keeps every event in daily gzipped NDJSON files in a local directory, to be searched with QueryArchive.
+// Each batch is appended to the file as its own gzip member, so a file cut short by a crash loses only the last batch.
+type ArchiveSink struct {
+	Dir    string
+	MaxAge int // days to keep files for; 0 keeps them all
+	mu     sync.Mutex
+}
+
+// NewArchiveSink returns a sink archiving into dir, creating it if needed
+func NewArchiveSink(dir string, maxAge int) (*ArchiveSink, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &ArchiveSink{Dir: dir, MaxAge: maxAge}, nil
+}
+
+// Name of the sink
+func (s *ArchiveSink) Name() string { return SinkArchive }
+
+// Send appends the events in b to the file for each event's day, then removes files older than MaxAge
+func (s *ArchiveSink) Send(ctx context.Context, b *EventBatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	days := make(map[string][]byte)
+	var order []string
+	for _, e := range b.Events {
+		eJSON, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		day := EventTime(&e).UTC().Format(archiveDateLayout)
+		if _, found := days[day]; !found {
+			order = append(order, day)
+		}
+		days[day] = append(append(days[day], eJSON...), '\n')
+	}
+	for _, day := range order {
+		if err := s.appendFile(filepath.Join(s.Dir, archivePrefix+day+archiveSuffix), days[day]); err != nil {
+			return err
+		}
+	}
+	return s.prune()
+}
+
+// appendFile adds ndjson to filename as a new gzip member
+func (s *ArchiveSink) appendFile(filename string, ndjson []byte) error {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	if _, err = zw.Write(ndjson); err != nil {
+		f.Close()
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// prune removes archive files older than MaxAge days
+func (s *ArchiveSink) prune() error {
+	if s.MaxAge <= 0 {
+		return nil
+	}
+	files, err := archiveFiles(s.Dir)
+	if err != nil {
+		return err
+	}
+	oldest := time.Now().UTC().AddDate(0, 0, -s.MaxAge).Format(archiveDateLayout)
+	for _, f := range files {
+		if f.day < oldest {
+			if err = os.Remove(f.path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close does nothing, as files are closed after each batch
+func (s *ArchiveSink) Close() error { return nil }
+
+// EventTime returns the time of e, or the current time if it has none
+func EventTime(e *SparkPostEvent) time.Time {
+	ts, err := strconv.ParseInt(e.EventWrapper.EventGrouping.TimeStamp, 10, 64)
+	if err != nil {
+		return time.Now()
+	}
+	return time.Unix(ts, 0)
+}
+
+type archiveFile struct {
+	path string
+	day  string
+}
+
+// archiveFiles returns the archive files in dir, oldest first
+func archiveFiles(dir string) ([]archiveFile, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, archivePrefix+"*"+archiveSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var files []archiveFile
+	for _, p := range paths {
+		day := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), archivePrefix), archiveSuffix)
+		if _, err := time.Parse(archiveDateLayout, day); err == nil {
+			files = append(files, archiveFile{path: p, day: day})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].day < files[j].day })
+	return files, nil
+}
+
+// EventQuery selects events from the archive. Blank fields match any event.
+type EventQuery struct {
+	MessageID string
+	RcptTo    string // matched ignoring case
+	Type      string // open, initial_open or click
+	From      time.Time
+	To        time.Time // events before this time
+}
+
+// Match returns true if e is selected by q
+func (q *EventQuery) Match(e *SparkPostEvent) bool {
+	g := &e.EventWrapper.EventGrouping
+	if q.MessageID != "" && g.MessageID != q.MessageID {
+		return false
+	}
+	if q.RcptTo != "" && !strings.EqualFold(g.RcptTo, q.RcptTo) {
+		return false
+	}
+	if q.Type != "" && g.Type != q.Type {
+		return false
+	}
+	if !q.From.IsZero() || !q.To.IsZero() {
+		t := EventTime(e)
+		if (!q.From.IsZero() && t.Before(q.From)) || (!q.To.IsZero() && !t.Before(q.To)) {
+			return false
+		}
+	}
+	return true
+}
+
+// QueryArchive calls f with each event in the archive in dir that is selected by q, oldest file first.
+// Only the files for days in q's time range are read.
+func QueryArchive(dir string, q EventQuery, f func(e *SparkPostEvent) error) error {
+	files, err := archiveFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, af := range files {
+		if (!q.From.IsZero() && af.day < q.From.UTC().Format(archiveDateLayout)) ||
+			(!q.To.IsZero() && af.day > q.To.UTC().Format(archiveDateLayout)) {
+			continue
+		}
+		if err = queryFile(af.path, q, f); err != nil {
+			return fmt.Errorf("%s: %w", af.path, err)
+		}
+	}
+	return nil
+}
+
+func queryFile(filename string, q EventQuery, f func(e *SparkPostEvent) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file) // reads all the gzip members in turn
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	s := bufio.NewScanner(zr)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		var e SparkPostEvent
+		if err = json.Unmarshal(s.Bytes(), &e); err != nil {
+			return err
+		}
+		if q.Match(&e) {
+			if err = f(&e); err != nil {
+				return err
+			}
+		}
+	}
+	return s.Err()
+}
@@ -0,0 +1,116 @@
+package sparkypmtatracking_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+// archiveEvent returns an event of type typ for msgID and rcpt, at time t
+func archiveEvent(typ, msgID, rcpt string, t time.Time) spmta.SparkPostEvent {
+	var e spmta.SparkPostEvent
+	g := &e.EventWrapper.EventGrouping
+	g.Type = typ
+	g.MessageID = msgID
+	g.RcptTo = rcpt
+	g.TimeStamp = strconv.FormatInt(t.Unix(), 10)
+	g.TargetLinkURL = testURL
+	return e
+}
+
+// queryIDs returns the type and message ID of each event in dir matching q
+func queryIDs(t *testing.T, dir string, q spmta.EventQuery) []string {
+	var got []string
+	err := spmta.QueryArchive(dir, q, func(e *spmta.SparkPostEvent) error {
+		got = append(got, e.EventWrapper.EventGrouping.Type+":"+e.EventWrapper.EventGrouping.MessageID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestArchive(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "archive")
+	s, err := spmta.NewArchiveSink(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day1 := time.Date(2020, 1, 7, 16, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	batches := [][]spmta.SparkPostEvent{
+		{archiveEvent("open", "m1", "bob@example.com", day1), archiveEvent("click", "m1", "bob@example.com", day1.Add(time.Minute))},
+		{archiveEvent("open", "m2", "alice@example.com", day1.Add(time.Hour)), archiveEvent("click", "m1", "bob@example.com", day2)},
+	}
+	for _, events := range batches {
+		if err = s.Send(context.Background(), &spmta.EventBatch{Events: events}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"events-2020-01-07.ndjson.gz", "events-2020-01-08.ndjson.gz"} {
+		if _, err = os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, c := range []struct {
+		q    spmta.EventQuery
+		want string
+	}{
+		{spmta.EventQuery{}, "[open:m1 click:m1 open:m2 click:m1]"},
+		{spmta.EventQuery{MessageID: "m1"}, "[open:m1 click:m1 click:m1]"},
+		{spmta.EventQuery{RcptTo: "Bob@Example.com", Type: "click"}, "[click:m1 click:m1]"},
+		{spmta.EventQuery{From: day1.Add(time.Minute), To: day2}, "[click:m1 open:m2]"},
+		{spmta.EventQuery{From: day2}, "[click:m1]"},
+		{spmta.EventQuery{RcptTo: "carol@example.com"}, "[]"},
+	} {
+		if got := queryIDs(t, dir, c.q); fmt.Sprint(got) != c.want {
+			t.Errorf("Query %+v: got %v, want %s", c.q, got, c.want)
+		}
+	}
+}
+
+func TestArchiveMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	s, err := spmta.NewArchiveSink(dir, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().AddDate(0, 0, -30)
+	events := []spmta.SparkPostEvent{archiveEvent("open", "m1", "bob@example.com", old), archiveEvent("open", "m2", "bob@example.com", time.Now())}
+	if err = s.Send(context.Background(), &spmta.EventBatch{Events: events}); err != nil {
+		t.Fatal(err)
+	}
+	if got := queryIDs(t, dir, spmta.EventQuery{}); fmt.Sprint(got) != "[open:m2]" {
+		t.Errorf("Expected old file to be removed, got %v", got)
+	}
+}
+
+func TestArchiveFaultyInputs(t *testing.T) {
+	if _, err := spmta.NewEventSink(spmta.SinkConfig{Sinks: []string{"archive"}}); err == nil {
+		t.Error("Expected an error")
+	}
+	// A file cut short
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "events-2020-01-07.ndjson.gz"), []byte{0x1f, 0x8b, 8, 0}, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := spmta.QueryArchive(dir, spmta.EventQuery{}, func(e *spmta.SparkPostEvent) error { return nil }); err == nil {
+		t.Error("Expected an error")
+	}
+	// Other files are ignored
+	dir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "events-latest.ndjson.gz"), []byte("junk"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if got := queryIDs(t, dir, spmta.EventQuery{}); len(got) != 0 {
+		t.Errorf("Unexpected %v", got)
+	}
+}
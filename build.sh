@@ -5,3 +5,4 @@ go build -v ./cmd/feeder
 go build -v ./cmd/tracker
 go build -v ./cmd/wrapper
 go build -v ./cmd/linktool
+go build -v ./cmd/eventquery
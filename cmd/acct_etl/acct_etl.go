@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -9,8 +10,10 @@ import (
 )
 
 func main() {
-	logfile := flag.String("logfile", "", "File written with message logs")
+	logOpts := spmta.LogFlags(flag.CommandLine)
 	infile := flag.String("infile", "", "Input file (omit to read from stdin)")
+	otlpEndpoint := flag.String("otlp_endpoint", "", "OTLP/HTTP collector URL to send traces to, e.g. http://localhost:4318 (tracing is off if blank)")
+	metricsHostPort := flag.String("metrics_hostport", "", "host:port to serve Prometheus metrics on, at /metrics (e.g. localhost:9105)")
 	flag.Usage = func() {
 		const helpText = "Extracts, transforms and loads accounting data fed by PowerMTA pipe into Redis\n" +
 			"Usage of %s:\n"
@@ -18,11 +21,16 @@ func main() {
 		flag.PrintDefaults()
 	}
 	flag.Parse()
-	spmta.MyLogger(*logfile)
-	fmt.Printf("Starting acct_etl, logging to %s\n", *logfile)
+	spmta.SetupLogging(*logOpts)
+	fmt.Printf("Starting acct_etl, logging to %s\n", logOpts.Filename)
+
+	spmta.ServeMetrics(*metricsHostPort)
+	shutdownTracing, err := spmta.SetupTracing("acct_etl", *otlpEndpoint)
+	if err != nil {
+		spmta.ConsoleAndLogFatal(err)
+	}
 
 	var f *os.File
-	var err error
 	if *infile == "" {
 		f = os.Stdin
 	} else {
@@ -32,6 +40,7 @@ func main() {
 		}
 	}
 	err = spmta.AccountETL(f)
+	shutdownTracing(context.Background()) // send spans before exiting
 	if err != nil {
 		spmta.ConsoleAndLogFatal(err)
 	}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+// parseTime accepts a time as RFC3339, or a date (midnight UTC). Blank gives the zero time, i.e. no limit.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// formatTime gives t as RFC3339, or "-" if it is not known
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func main() {
+	archiveDir := flag.String("archive_dir", "archive", "Directory of event files written by the feeder archive sink")
+	messageID := flag.String("message_id", "", "Only events for this message_id")
+	rcptTo := flag.String("rcpt_to", "", "Only events for this recipient")
+	eventType := flag.String("type", "", "Only events of this type [open|initial_open|click]")
+	from := flag.String("from", "", "Only events at or after this time, e.g. 2020-01-07 or 2020-01-07T16:00:00Z")
+	to := flag.String("to", "", "Only events before this time, e.g. 2020-01-08 or 2020-01-07T17:00:00Z")
+	asJSON := flag.Bool("json", false, "Write matching events as NDJSON, instead of a table")
+	summary := flag.Bool("summary", false, "Total the opens and clicks of each message, instead of listing events")
+	flag.Usage = func() {
+		const helpText = "Searches the feeder's local archive of open and click events\n" +
+			"Usage of %s:\n"
+		fmt.Fprintf(flag.CommandLine.Output(), helpText, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	q := spmta.EventQuery{MessageID: *messageID, RcptTo: *rcptTo, Type: *eventType}
+	var err error
+	if q.From, err = parseTime(*from); err != nil {
+		fmt.Println("from:", err)
+		os.Exit(1)
+	}
+	if q.To, err = parseTime(*to); err != nil {
+		fmt.Println("to:", err)
+		os.Exit(1)
+	}
+
+	found := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	enc := json.NewEncoder(os.Stdout)
+	var sum spmta.EngagementSummary
+	if !*asJSON {
+		if *summary {
+			fmt.Fprintln(tw, "MESSAGE_ID\tRCPT_TO\tOPENS\tCLICKS\tLINKS_CLICKED\tFIRST_OPEN\tFIRST_CLICK")
+		} else {
+			fmt.Fprintln(tw, "TIME\tTYPE\tMESSAGE_ID\tRCPT_TO\tTARGET_LINK_URL\tUSER_AGENT")
+		}
+	}
+	err = spmta.QueryArchive(*archiveDir, q, func(e *spmta.SparkPostEvent) error {
+		found++
+		if *summary {
+			sum.Add(e)
+			return nil
+		}
+		if *asJSON {
+			return enc.Encode(e)
+		}
+		g := &e.EventWrapper.EventGrouping
+		_, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", spmta.EventTime(e).UTC().Format(time.RFC3339), g.Type, g.MessageID,
+			g.RcptTo, g.TargetLinkURL, g.UserAgent)
+		return err
+	})
+	if err == nil && *summary {
+		for _, m := range sum.Messages() {
+			if *asJSON {
+				err = enc.Encode(m)
+			} else {
+				_, err = fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%s\t%s\n", m.MessageID, m.RcptTo, m.Opens, m.Clicks, m.LinksClicked,
+					formatTime(m.FirstOpen), formatTime(m.FirstClick))
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	tw.Flush()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "%d events found\n", found)
+}
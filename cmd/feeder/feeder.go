@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	spmta "github.com/tuck1s/sparkypmtatracking"
 )
@@ -12,27 +16,123 @@ import (
 func main() {
 	const spHostEnvVar = "SPARKPOST_HOST_INGEST"
 	const spAPIKeyEnvVar = "SPARKPOST_API_KEY_INGEST"
-	logfile := flag.String("logfile", "", "File written with message logs")
+	const webhookAuthEnvVar = "FEEDER_WEBHOOK_AUTH"
+	const webhookHMACEnvVar = "FEEDER_WEBHOOK_HMAC_KEY"
+	logOpts := spmta.LogFlags(flag.CommandLine)
+	healthHostPort := flag.String("health_hostport", "", "host:port to serve /healthz and /readyz health checks on (e.g. localhost:9113)")
+	otlpEndpoint := flag.String("otlp_endpoint", "", "OTLP/HTTP collector URL to send traces to, e.g. http://localhost:4318 (tracing is off if blank)")
+	metricsHostPort := flag.String("metrics_hostport", "", "host:port to serve Prometheus metrics on, at /metrics (e.g. localhost:9103)")
+	sinks := flag.String("sinks", spmta.SinkSparkPost, "Comma-separated event sinks to send to, main sink first: sparkpost, webhook, file, kafka, stdout, archive")
+	webhookURL := flag.String("webhook_url", "", "URL to POST batches of events to, as a JSON array, for the webhook sink")
+	webhookAuthHeader := flag.String("webhook_auth_header", "Authorization", "Header to send the webhook auth value in")
+	webhookFormat := flag.String("webhook_format", spmta.WebhookFormatMsys, "Webhook body format: msys (as sent by SparkPost webhooks), or events")
+	webhooksFile := flag.String("webhooks", "", "JSON file of webhook endpoints, each with its own format, auth and retry settings, for the webhook sink")
+	eventsFile := flag.String("events_file", "", "File to append events to as NDJSON, for the file sink")
+	eventsFileMaxSize := flag.Int("events_file_max_size", 100, "Megabytes written to events_file before it is rotated")
+	eventsFileMaxAge := flag.Int("events_file_max_age", 0, "Days to keep rotated events files (0 keeps all)")
+	eventsFileMaxBackups := flag.Int("events_file_max_backups", 0, "Number of rotated events files to keep (0 keeps all)")
+	kafkaRESTURL := flag.String("kafka_rest_url", "", "Kafka REST Proxy base URL, e.g. http://localhost:8082, for the kafka sink")
+	kafkaTopic := flag.String("kafka_topic", "engagement-events", "Kafka topic to produce events to")
+	archiveDir := flag.String("archive_dir", "", "Directory to keep daily files of events in, for the archive sink. Search them with eventquery")
+	archiveMaxAge := flag.Int("archive_max_age", 0, "Days to keep archive files (0 keeps all)")
+	dedupWindow := flag.Duration("dedup_window", 0, "Drop repeats of the same action on the same link of a message within this time, e.g. 1m (0 keeps all)")
+	firstOpenOnly := flag.Bool("first_open_only", false, "Send only the first open of each message")
+	batchMaxBytes := flag.Int("batch_max_bytes", spmta.SparkPostIngestMaxPayload, "Batches are kept smaller than this many bytes. The sparkpost sink accepts up to 5MB")
+	batchMaxEvents := flag.Int("batch_max_events", 0, "Most events to send in a batch (0 means no limit)")
+	batchMaxAge := flag.Duration("batch_max_age", spmta.SparkPostIngestBatchMaxAge, "Longest time to hold events before sending them")
+	pollInterval := flag.Duration("poll_interval", spmta.FeedDefaultPollInterval, "Longest time to wait for an event on the queue")
+	workers := flag.Int("workers", 1, "Most batches to send at once. More workers keep up with a busy queue when sinks are slow to respond")
+	stream := flag.Bool("stream", false, "Read events from the Redis stream, sharing them with other feeders in a consumer group, rather than the queue")
+	consumer := flag.String("consumer", "", "Name of this feeder in the consumer group, with -stream. Each feeder needs its own name (default is the host name)")
+	claimAfter := flag.Duration("claim_after", spmta.FeedDefaultClaimAfter, "With -stream, claim events another feeder has taken and not sent within this time")
 	flag.Usage = func() {
-		const helpText = "Takes the opens and clicks from the Redis queue and feeds them to the SparkPost Ingest API\n" +
-			"Requires environment variable %s and optionally %s\n" +
+		const helpText = "Takes the opens and clicks from the Redis queue and feeds them to the SparkPost Ingest API, and other event sinks\n" +
+			"The sparkpost sink requires environment variable %s and optionally %s\n" +
+			"The webhook sink optionally takes its auth value from %s, and a key to sign the body with from %s\n" +
 			"Usage of %s:\n"
-		fmt.Fprintf(flag.CommandLine.Output(), helpText, spAPIKeyEnvVar, spHostEnvVar, os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), helpText, spAPIKeyEnvVar, spHostEnvVar, webhookAuthEnvVar, webhookHMACEnvVar, os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
-	spmta.MyLogger(*logfile)
-	if *logfile != "" {
-		fmt.Println("Starting feeder service, logging to", *logfile)
+	spmta.SetupLogging(*logOpts)
+	if logOpts.Filename != "" {
+		fmt.Println("Starting feeder service, logging to", logOpts.Filename)
 	}
-	log.Println("Starting feeder service")
+	slog.Info("Starting feeder service")
 
-	// Get SparkPost ingest info from env vars
-	host := spmta.HostCleanup(spmta.GetenvDefault(spHostEnvVar, "api.sparkpost.com"))
-	apiKey := spmta.GetenvDefault(spAPIKeyEnvVar, "")
-	if apiKey == "" {
-		spmta.ConsoleAndLogFatal(fmt.Sprintf("%s not set - stopping", spAPIKeyEnvVar))
+	// Get SparkPost ingest info, and webhook secrets, from env vars
+	sinkConfig := spmta.SinkConfig{
+		Sinks:             strings.Split(*sinks, ","),
+		IngestHost:        spmta.HostCleanup(spmta.GetenvDefault(spHostEnvVar, "api.sparkpost.com")),
+		IngestAPIKey:      spmta.GetenvDefault(spAPIKeyEnvVar, ""),
+		WebhookURL:        *webhookURL,
+		WebhookFormat:     *webhookFormat,
+		WebhookAuthHeader: *webhookAuthHeader,
+		WebhookAuthValue:  spmta.GetenvDefault(webhookAuthEnvVar, ""),
+		WebhookHMACKey:    []byte(spmta.GetenvDefault(webhookHMACEnvVar, "")),
+		FilePath:          *eventsFile,
+		FileMaxSize:       *eventsFileMaxSize,
+		FileMaxBackups:    *eventsFileMaxBackups,
+		FileMaxAge:        *eventsFileMaxAge,
+		KafkaRESTURL:      *kafkaRESTURL,
+		KafkaTopic:        *kafkaTopic,
+		ArchiveDir:        *archiveDir,
+		ArchiveMaxAge:     *archiveMaxAge,
 	}
+	var err error
+	if sinkConfig.WebhookAuthValue == "" {
+		sinkConfig.WebhookAuthHeader = ""
+	}
+	if *webhooksFile != "" {
+		if sinkConfig.Webhooks, err = spmta.LoadWebhooks(*webhooksFile); err != nil {
+			spmta.ConsoleAndLogFatal(fmt.Sprintf("%s: %v - stopping", *webhooksFile, err))
+		}
+	}
+	sink, err := spmta.NewEventSink(sinkConfig)
+	if err != nil {
+		spmta.ConsoleAndLogFatal(fmt.Sprintf("%v - stopping", err))
+	}
+	defer sink.Close()
+	slog.Info("Sending events", "sinks", sink.Name())
+	if *batchMaxBytes > spmta.SparkPostIngestMaxPayload && strings.Contains(","+sink.Name()+",", ","+spmta.SinkSparkPost+",") {
+		spmta.ConsoleAndLogFatal(fmt.Sprintf("batch_max_bytes can be at most %d for the sparkpost sink - stopping", spmta.SparkPostIngestMaxPayload))
+	}
+
+	shutdownTracing, err := spmta.SetupTracing("feeder", *otlpEndpoint)
+	if err != nil {
+		spmta.ConsoleAndLogFatal(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	client := spmta.MyRedis()
+	spmta.ServeMetrics(*metricsHostPort)
 
-	spmta.FeedForever(spmta.MyRedis(), host, apiKey, spmta.SparkPostIngestBatchMaxAge)
+	// On SIGINT / SIGTERM, send any buffered events then exit
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	feeder := spmta.Feeder{
+		Client:       client,
+		Sink:         sink,
+		MaxAge:       *batchMaxAge,
+		MaxBytes:     *batchMaxBytes,
+		MaxEvents:    *batchMaxEvents,
+		PollInterval: *pollInterval,
+		Workers:      *workers,
+	}
+	if *dedupWindow > 0 || *firstOpenOnly {
+		feeder.Dedup = &spmta.Dedup{Window: *dedupWindow, FirstOpenOnly: *firstOpenOnly}
+		slog.Info("Dropping duplicate events", "dedup_window", *dedupWindow, "first_open_only", *firstOpenOnly)
+	}
+	if *stream {
+		if *consumer == "" {
+			if *consumer, err = os.Hostname(); err != nil {
+				spmta.ConsoleAndLogFatal(fmt.Sprintf("%v - give a consumer name - stopping", err))
+			}
+		}
+		feeder.Consumer, feeder.ClaimAfter = *consumer, *claimAfter
+		slog.Info("Reading events from Redis stream", "stream", spmta.RedisStream, "group", spmta.FeederGroup, "consumer", *consumer)
+	}
+	spmta.ServeHealth(*healthHostPort, feeder.Ready())
+	feeder.FeedForever(ctx)
+	slog.Info("Feeder service stopped")
 }
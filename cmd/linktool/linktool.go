@@ -13,6 +13,19 @@ func usageNQuit() {
 	os.Exit(1)
 }
 
+// loadKeys returns the link keys from filename, or nil if filename is blank
+func loadKeys(filename string) *spmta.LinkKeys {
+	if filename == "" {
+		return nil
+	}
+	keys, err := spmta.LoadLinkKeys(filename)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return keys
+}
+
 func main() {
 	encodeCmd := flag.NewFlagSet("encode", flag.ExitOnError)
 	encodeMessageID := encodeCmd.String("message_id", "0000123456789abcdef0", "message_id")
@@ -20,14 +33,21 @@ func main() {
 	encodeAction := encodeCmd.String("action", "open", "[open|initial_open|click]")
 	encodeTargetLinkURL := encodeCmd.String("target_link_url", "https://example.com", "URL of your target link")
 	encodeTrackingURL := encodeCmd.String("tracking_url", "http://localhost:8888", "URL of your tracking service endpoint")
+	encodeSigningKey := encodeCmd.String("signing_key", "", "Key to sign the link with (optional)")
+	encodeShort := encodeCmd.Bool("short", false, "Make a short link, storing the link data in Redis")
+	encodeLinkParams := encodeCmd.String("link_params", "", "Query parameters to add to the target link, e.g. utm_source=email&utm_campaign={{.Campaign}} (optional)")
+	encodeCampaign := encodeCmd.String("campaign", "", "Campaign, for use in link_params")
+	encodeLinkKeys := encodeCmd.String("link_keys", "", "JSON file of keys, to make an encrypted link (optional)")
 	encodeCmd.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "\nencode\n")
 		encodeCmd.PrintDefaults()
 	}
 
 	decodeCmd := flag.NewFlagSet("decode", flag.ExitOnError)
+	decodeSigningKey := decodeCmd.String("signing_key", "", "Key to check the link signature with (optional)")
+	decodeLinkKeys := decodeCmd.String("link_keys", "", "JSON file of keys, to decrypt encrypted links (optional)")
 	decodeCmd.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "\ndecode url\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "\ndecode [flags] url\n")
 		decodeCmd.PrintDefaults()
 	}
 
@@ -46,7 +66,23 @@ func main() {
 		if err := encodeCmd.Parse(os.Args[2:]); err != nil {
 			usageNQuit()
 		}
-		link, err := spmta.EncodeLink(*encodeTrackingURL, *encodeAction, *encodeMessageID, *encodeRcptTo, *encodeTargetLinkURL, true, true, true)
+		w, err := spmta.NewWrapper(*encodeTrackingURL, true, true, true)
+		if err != nil {
+			fmt.Println(err)
+			usageNQuit()
+		}
+		w.SetSigningKey(*encodeSigningKey)
+		if *encodeShort {
+			w.SetLinkStore(spmta.NewRedisLinkStore(spmta.MyRedis(), spmta.LinkTTL))
+		}
+		w.SetLinkKeys(loadKeys(*encodeLinkKeys))
+		if err = w.SetLinkParams(*encodeLinkParams); err != nil {
+			fmt.Println(err)
+			usageNQuit()
+		}
+		w.SetCampaign(*encodeCampaign)
+		w.SetMessageInfo(*encodeMessageID, *encodeRcptTo)
+		link, err := w.Link(*encodeAction, *encodeTargetLinkURL)
 		if err != nil {
 			fmt.Println(err)
 			usageNQuit()
@@ -57,11 +93,19 @@ func main() {
 		if err := decodeCmd.Parse(os.Args[2:]); err != nil {
 			usageNQuit()
 		}
-		if len(os.Args) < 3 {
+		if decodeCmd.NArg() < 1 {
 			usageNQuit()
 		}
-
-		eBytes, wd, decodeTrackingURL, err := spmta.DecodeLink(os.Args[2])
+		link := decodeCmd.Arg(0)
+		if *decodeSigningKey != "" {
+			if err := spmta.VerifyLink(link, []byte(*decodeSigningKey)); err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Println("Signature: valid")
+			}
+		}
+		keys := loadKeys(*decodeLinkKeys)
+		eBytes, wd, decodeTrackingURL, err := spmta.ResolveLink(link, spmta.NewRedisLinkStore(spmta.MyRedis(), spmta.LinkTTL), keys)
 		if err != nil {
 			fmt.Println(err)
 		}
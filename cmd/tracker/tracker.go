@@ -1,36 +1,205 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	spmta "github.com/tuck1s/sparkypmtatracking"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 func main() {
 	inHostPort := flag.String("in_hostport", ":8888", "host:port to serve incoming HTTP requests")
-	logfile := flag.String("logfile", "", "File written with message logs")
+	logOpts := spmta.LogFlags(flag.CommandLine)
+	shutdownTimeout := flag.Duration("shutdown_timeout", 30*time.Second, "Time allowed for in-flight requests to complete on SIGTERM")
+	certfile := flag.String("certfile", "", "Certificate file, to serve https directly")
+	privkeyfile := flag.String("privkeyfile", "", "Private key file, to serve https directly")
+	autocertDomains := flag.String("autocert_domains", "", "Comma-separated tracking domains to get certificates for automatically via ACME (e.g. LetsEncrypt)")
+	autocertCache := flag.String("autocert_cache", "autocert-cache", "Directory to cache ACME certificates")
+	configFile := flag.String("config", "", "JSON file of per-host settings for each tracking domain served. Requests for other hosts are rejected")
+	linkKeys := flag.String("link_keys", "", "JSON file of keys to decrypt encrypted links with")
+	metricsHostPort := flag.String("metrics_hostport", "", "host:port to serve Prometheus metrics on, at /metrics (e.g. localhost:9102)")
+	otlpEndpoint := flag.String("otlp_endpoint", "", "OTLP/HTTP collector URL to send traces to, e.g. http://localhost:4318 (tracing is off if blank)")
+	redirectHostPort := flag.String("redirect_hostport", "", "host:port to serve plain http, redirecting to https (e.g. :80). Needed for ACME http-01 challenges")
+	stream := flag.Bool("stream", false, "Add events to the Redis stream, for feeders run with -stream, rather than the queue")
+	queueMaxLength := flag.Int64("queue_max_length", 0, "Most events to keep waiting for the feeders (0 means no limit)")
+	queueOverflow := flag.String("queue_overflow", spmta.OverflowDropOldest, "What to do with events when the queue is full: drop_oldest, drop_newest, or spill to queue_spill_file")
+	queueSpillFile := flag.String("queue_spill_file", "", "File to append events to as NDJSON when the queue is full, with -queue_overflow spill")
 	flag.Usage = func() {
 		const helpText = "Web service that decodes client email opens and clicks\n" +
-			"Runs in plain mode, it should proxied (e.g. by nginx) to provide https and protection.\n" +
+			"Runs in plain mode, unless certificates are given; it can be proxied (e.g. by nginx) to provide https and protection.\n" +
 			"Usage of %s:\n"
 		fmt.Fprintf(flag.CommandLine.Output(), helpText, os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
-	spmta.MyLogger(*logfile)
-	fmt.Printf("Starting http server on %s, logging to %s\n", *inHostPort, *logfile)
-	log.Printf("Starting http server on %s\n", *inHostPort)
+	spmta.SetupLogging(*logOpts)
+	fmt.Printf("Starting http server on %s, logging to %s\n", *inHostPort, logOpts.Filename)
+	slog.Info("Starting http server", "addr", *inHostPort)
+	shutdownTracing, err := spmta.SetupTracing("tracker", *otlpEndpoint)
+	if err != nil {
+		spmta.ConsoleAndLogFatal(err)
+	}
+	defer shutdownTracing(context.Background())
 	// http server
-	http.HandleFunc("/", spmta.TrackingServer) // Accept subtree matches
+	var tracker *spmta.Tracker
+	if *configFile != "" {
+		cfg, err := spmta.LoadTrackerConfig(*configFile)
+		if err != nil {
+			spmta.ConsoleAndLogFatal(err)
+		}
+		tracker = spmta.NewTracker(cfg)
+		for h := range cfg.Hosts {
+			slog.Info("Serving tracking domain", "host", h)
+		}
+	} else {
+		tracker = spmta.NewTracker(nil) // accept any host
+	}
+	if *linkKeys != "" {
+		keys, err := spmta.LoadLinkKeys(*linkKeys)
+		if err != nil {
+			spmta.ConsoleAndLogFatal(err)
+		}
+		tracker.Keys = keys
+		slog.Info("Decrypting links", "link_keys", *linkKeys)
+	}
+	if *stream {
+		tracker.Stream = true
+		slog.Info("Adding events to Redis stream", "stream", spmta.RedisStream)
+	}
+	if *queueMaxLength > 0 {
+		limit, err := spmta.NewQueueLimit(*queueMaxLength, *queueOverflow, *queueSpillFile)
+		if err != nil {
+			spmta.ConsoleAndLogFatal(err)
+		}
+		defer limit.Close()
+		tracker.Limit = limit
+		slog.Info("Limiting queue length", "queue_max_length", *queueMaxLength, "queue_overflow", *queueOverflow, "queue_spill_file", *queueSpillFile)
+	}
+	http.Handle("/", tracker) // Accept subtree matches
+	spmta.HandleHealth(http.DefaultServeMux, spmta.TrackerReady)
 	server := &http.Server{
-		Addr: *inHostPort,
+		Addr:              *inHostPort,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       120 * time.Second,
 	}
-	err := server.ListenAndServe()
-	if err != nil {
+	servers := []*http.Server{server}
+
+	// TLS from certificate files, or automatically from ACME
+	var redirectHandler http.Handler
+	switch {
+	case *autocertDomains != "":
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(*autocertCache),
+			HostPolicy: autocert.HostWhitelist(strings.Split(*autocertDomains, ",")...),
+		}
+		server.TLSConfig = spmta.TrackerTLSConfig()
+		server.TLSConfig.GetCertificate = m.GetCertificate
+		server.TLSConfig.NextProtos = append(server.TLSConfig.NextProtos, acme.ALPNProto)
+		redirectHandler = m.HTTPHandler(spmta.HTTPSRedirect(port(*inHostPort)))
+		slog.Info("Serving https with ACME certificates", "domains", *autocertDomains, "cache", *autocertCache)
+	case *certfile != "" && *privkeyfile != "":
+		cert, err := tls.LoadX509KeyPair(*certfile, *privkeyfile)
+		if err != nil {
+			spmta.ConsoleAndLogFatal(err)
+		}
+		server.TLSConfig = spmta.TrackerTLSConfig()
+		server.TLSConfig.Certificates = []tls.Certificate{cert}
+		redirectHandler = spmta.HTTPSRedirect(port(*inHostPort))
+		slog.Info("Serving https", "certfile", *certfile, "privkeyfile", *privkeyfile)
+	}
+	// Per-host certificates from the config file are chosen by SNI, falling back to the certificates above
+	if tracker.Config != nil && tracker.Config.HasCertificates() {
+		if server.TLSConfig == nil {
+			server.TLSConfig = spmta.TrackerTLSConfig()
+			redirectHandler = spmta.HTTPSRedirect(port(*inHostPort))
+		}
+		server.TLSConfig.GetCertificate = chainGetCertificate(tracker.Config.GetCertificate, server.TLSConfig.GetCertificate)
+		slog.Info("Serving https with per-host certificates", "config", *configFile)
+	}
+	if *redirectHostPort != "" {
+		if redirectHandler == nil {
+			spmta.ConsoleAndLogFatal("redirect_hostport needs certfile and privkeyfile, or autocert_domains")
+		}
+		redirectServer := &http.Server{
+			Addr:              *redirectHostPort,
+			Handler:           redirectHandler,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		servers = append(servers, redirectServer)
+		slog.Info("Redirecting http to https", "addr", *redirectHostPort)
+		go func() {
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				spmta.ConsoleAndLogFatal(err)
+			}
+		}()
+	}
+
+	if metricsServer := spmta.ServeMetrics(*metricsHostPort); metricsServer != nil {
+		servers = append(servers, metricsServer)
+	}
+
+	// On SIGINT / SIGTERM, stop accepting connections and let in-flight requests complete
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		slog.Info("Shutting down http server")
+		sctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		for _, s := range servers {
+			if err := s.Shutdown(sctx); err != nil {
+				slog.Warn("Shutdown error", "addr", s.Addr, "error", err)
+			}
+		}
+	}()
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "") // certificates are already in TLSConfig
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		spmta.ConsoleAndLogFatal(err)
 	}
+	<-drained // ListenAndServe returns straight away on Shutdown, so wait for requests to complete
+	slog.Info("Http server stopped")
+}
+
+// port returns the port part of a host:port string
+func port(hostPort string) string {
+	_, p, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return ""
+	}
+	return p
+}
+
+// chainGetCertificate returns a function that tries each GetCertificate function in turn, until one returns a certificate
+func chainGetCertificate(fns ...func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		for _, f := range fns {
+			if f == nil {
+				continue
+			}
+			cert, err := f(hello)
+			if cert != nil || err != nil {
+				return cert, err
+			}
+		}
+		return nil, nil // tls package then uses tls.Config.Certificates
+	}
 }
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/tuck1s/go-smtpproxy"
@@ -18,7 +20,7 @@ func main() {
 	outHostPort := flag.String("out_hostport", "smtp.sparkpostmail.com:587", "host:port for onward routing of SMTP requests")
 	certfile := flag.String("certfile", "", "Certificate file for this server")
 	privkeyfile := flag.String("privkeyfile", "", "Private key file for this server")
-	logfile := flag.String("logfile", "", "File written with message logs (also to stdout)")
+	logOpts := spmta.LogFlags(flag.CommandLine)
 	verboseOpt := flag.Bool("verbose", false, "print out lots of messages")
 	downstreamDebug := flag.String("downstream_debug", "", "File to write downstream server SMTP conversation for debugging")
 	upstreamDataDebug := flag.String("upstream_data_debug", "", "File to write upstream DATA for debugging")
@@ -26,7 +28,16 @@ func main() {
 	trackOpen := flag.Bool("track_open", true, "Insert an open tracking pixel at bottom of HTML mail")
 	trackInitialOpen := flag.Bool("track_initial_open", false, "Insert an initial_open tracking pixel at top of HTML mail")
 	trackLink := flag.Bool("track_click", false, "Wrap links in HTML mail, to track clicks")
+	signingKey := flag.String("signing_key", "", "Key to sign links with, matching the tracker's signing_key for the tracking domain (links are not signed if blank)")
 	insecureSkipVerify := flag.Bool("insecure_skip_verify", false, "Skip check of peer cert on upstream side")
+	policyFile := flag.String("policy", "", "JSON file of per-sender tracking rules (reloaded on SIGHUP)")
+	shutdownTimeout := flag.Duration("shutdown_timeout", 60*time.Second, "Time allowed for messages in progress to complete on SIGTERM")
+	shortLinks := flag.Bool("short_links", false, "Make short links carrying only an id, with the link data kept in Redis")
+	linkKeys := flag.String("link_keys", "", "JSON file of keys to encrypt link data with (reloaded on SIGHUP)")
+	linkParams := flag.String("link_params", "", "Query parameters to add to target links, e.g. utm_source=email&utm_campaign={{.Campaign}}")
+	metricsHostPort := flag.String("metrics_hostport", "", "host:port to serve Prometheus metrics on, at /metrics (e.g. localhost:9104)")
+	otlpEndpoint := flag.String("otlp_endpoint", "", "OTLP/HTTP collector URL to send traces to, e.g. http://localhost:4318 (tracing is off if blank)")
+	configFile := flag.String("config", "", "JSON file of tracking and verbose settings, overriding the flags (reloaded on SIGHUP)")
 	flag.Usage = func() {
 		const helpText = "SMTP proxy that accepts incoming messages from your downstream client, applies engagement-tracking\n" +
 			"(wrapping links and adding open tracking pixels) and relays on to an upstream server.\n" +
@@ -35,74 +46,155 @@ func main() {
 		flag.PrintDefaults()
 	}
 	flag.Parse()
-	spmta.MyLogger(*logfile)
-	fmt.Println("Starting smtp proxy service on port", *inHostPort, ", logging to", *logfile)
-	log.Println("Starting smtp proxy service on port", *inHostPort)
-	log.Println("Outgoing host:port set to", *outHostPort)
-	log.Printf("Engagement tracking URL: %s, track_open %v, track_initial_open %v, track_click %v\n", *trackingURL, *trackOpen, *trackInitialOpen, *trackLink)
-	myWrapper, err := spmta.NewWrapper(*trackingURL, *trackOpen, *trackInitialOpen, *trackLink)
-	if err != nil && !strings.Contains(err.Error(), "empty url") {
-		log.Fatal(err)
+	spmta.SetupLogging(*logOpts)
+	fmt.Println("Starting smtp proxy service on port", *inHostPort, ", logging to", logOpts.Filename)
+	slog.Info("Starting smtp proxy service", "addr", *inHostPort)
+	slog.Info("Outgoing host:port set", "out_hostport", *outHostPort)
+	shutdownTracing, err := spmta.SetupTracing("wrapper", *otlpEndpoint)
+	if err != nil {
+		spmta.ConsoleAndLogFatal(err)
 	}
+	defer shutdownTracing(context.Background())
+	flagConfig := spmta.WrapperConfig{
+		TrackingURL:      *trackingURL,
+		TrackOpen:        *trackOpen,
+		TrackInitialOpen: *trackInitialOpen,
+		TrackLink:        *trackLink,
+		SigningKey:       *signingKey,
+		ShortLinks:       *shortLinks,
+		LinkKeysFile:     *linkKeys,
+		LinkParams:       *linkParams,
+		Verbose:          *verboseOpt,
+		PolicyFile:       *policyFile,
+	}
+	cfg, err := loadConfig(flagConfig, *configFile)
+	if err != nil {
+		spmta.ConsoleAndLogFatal(err)
+	}
+	logConfig(cfg)
 
 	// Logging of upstream server DATA (in RFC822 .eml format) for debugging
 	var upstreamDebugFile *os.File // need this not in inner scope
 	if *upstreamDataDebug != "" {
 		upstreamDebugFile, err = os.OpenFile(*upstreamDataDebug, os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
-			log.Fatal(err)
+			spmta.ConsoleAndLogFatal(err)
 		}
-		log.Println("Proxy writing upstream DATA to", upstreamDebugFile.Name())
+		slog.Info("Proxy writing upstream DATA", "file", upstreamDebugFile.Name())
 		defer upstreamDebugFile.Close()
 	}
 
 	// Set up parameters that the backend will use
-	be := spmta.NewBackend(*outHostPort, *verboseOpt, upstreamDebugFile, myWrapper, *insecureSkipVerify)
+	be := spmta.NewBackend(*outHostPort, cfg.Verbose, upstreamDebugFile, nil, *insecureSkipVerify)
+	be.SetLinkStore(spmta.NewRedisLinkStore(spmta.MyRedis(), spmta.LinkTTL))
+	if err = be.ApplyConfig(cfg); err != nil {
+		spmta.ConsoleAndLogFatal(err)
+	}
+	go reloadOnHangup(be, flagConfig, *configFile)
 	s := smtpproxy.NewServer(be)
 	s.Addr = *inHostPort
 	s.ReadTimeout = 60 * time.Second
 	s.WriteTimeout = 60 * time.Second
+	be.SetReadTimeout(s.ReadTimeout)
 
 	// Gather TLS credentials for the proxy server
 	if *certfile != "" && *privkeyfile != "" {
 		cert, err := ioutil.ReadFile(*certfile)
 		if err != nil {
-			log.Fatal(err)
+			spmta.ConsoleAndLogFatal(err)
 		}
 		privkey, err := ioutil.ReadFile(*privkeyfile)
 		if err != nil {
-			log.Fatal(err)
+			spmta.ConsoleAndLogFatal(err)
 		}
-		log.Println("Gathered certificate", *certfile, "and key", *privkeyfile)
+		slog.Info("Gathered certificate", "certfile", *certfile, "privkeyfile", *privkeyfile)
 		err = s.ServeTLS(cert, privkey)
 		if err != nil {
-			log.Fatal(err)
+			spmta.ConsoleAndLogFatal(err)
 		}
 	} else {
-		log.Println("certfile or privkeyfile not specified - proxy will NOT offer STARTTLS to clients")
+		slog.Warn("certfile or privkeyfile not specified - proxy will NOT offer STARTTLS to clients")
 		s.Domain, err = os.Hostname() // This is the fallback in case we have no cert / privkey to give us a Subject
 		if err != nil {
-			log.Fatal("Can't read hostname")
+			spmta.ConsoleAndLogFatal("Can't read hostname")
 		}
 	}
 
-	log.Println("Proxy will advertise itself as", s.Domain)
-	log.Println("Verbose SMTP conversation logging:", *verboseOpt)
-	log.Println("insecure_skip_verify (Skip check of peer cert on upstream side):", *insecureSkipVerify)
+	slog.Info("Proxy will advertise itself", "domain", s.Domain)
+	slog.Info("Verbose SMTP conversation logging", "verbose", cfg.Verbose)
+	slog.Info("Skip check of peer cert on upstream side", "insecure_skip_verify", *insecureSkipVerify)
 
 	// Logging of downstream (client to proxy server) commands and responses
 	if *downstreamDebug != "" {
 		dbgFile, err := os.OpenFile(*downstreamDebug, os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
-			log.Fatal(err)
+			spmta.ConsoleAndLogFatal(err)
 		}
 		defer dbgFile.Close()
 		s.Debug = dbgFile
-		log.Println("Proxy logging SMTP commands, responses and downstream DATA to", dbgFile.Name())
+		slog.Info("Proxy logging SMTP commands, responses and downstream DATA", "file", dbgFile.Name())
 	}
 
+	spmta.ServeMetrics(*metricsHostPort)
+
 	// Begin serving requests
-	if err := s.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.ListenAndServe()
+	}()
+	// On SIGINT / SIGTERM, refuse new sessions, let messages in the DATA phase complete, then close
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serveErr:
+		spmta.ConsoleAndLogFatal(err)
+	case <-ctx.Done():
+		slog.Info("Shutting down smtp proxy service, waiting for messages in progress", "timeout", *shutdownTimeout)
+		if !be.Drain(*shutdownTimeout) {
+			slog.Warn("Shutdown timeout - closing with messages still in progress")
+		}
+		s.Close()
+		slog.Info("Smtp proxy service stopped")
+	}
+}
+
+// loadConfig returns the flag settings, overridden by the config file if given
+func loadConfig(flagConfig spmta.WrapperConfig, configFile string) (spmta.WrapperConfig, error) {
+	if configFile == "" {
+		return flagConfig, nil
+	}
+	return spmta.LoadWrapperConfig(flagConfig, configFile)
+}
+
+func logConfig(cfg spmta.WrapperConfig) {
+	slog.Info("Engagement tracking", "tracking_url", cfg.TrackingURL, "track_open", cfg.TrackOpen, "track_initial_open", cfg.TrackInitialOpen,
+		"track_click", cfg.TrackLink, "short_links", cfg.ShortLinks)
+	if cfg.PolicyFile != "" {
+		slog.Info("Tracking policy", "policy", cfg.PolicyFile)
+	}
+	if cfg.LinkParams != "" {
+		slog.Info("Adding parameters to target links", "link_params", cfg.LinkParams)
+	}
+	if cfg.LinkKeysFile != "" {
+		slog.Info("Encrypting links", "link_keys", cfg.LinkKeysFile)
+	}
+}
+
+// reloadOnHangup re-reads the config and policy files each time SIGHUP is received, and swaps the new settings into the
+// running backend without dropping SMTP sessions. If the new files are faulty, the previous settings are kept.
+func reloadOnHangup(be *spmta.Backend, flagConfig spmta.WrapperConfig, configFile string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		cfg, err := loadConfig(flagConfig, configFile)
+		if err == nil {
+			err = be.ApplyConfig(cfg)
+		}
+		if err != nil {
+			slog.Error("Configuration reload failed, keeping previous settings", "error", err)
+			continue
+		}
+		slog.Info("Configuration reloaded")
+		logConfig(cfg)
 	}
 }
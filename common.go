@@ -1,8 +1,10 @@
 package sparkypmtatracking
 
 import (
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"strconv"
 	"strings"
@@ -15,19 +17,62 @@ import (
 // ConsoleAndLogFatal writes error to both log and stdout
 func ConsoleAndLogFatal(s ...interface{}) {
 	fmt.Println(s...)
-	log.Fatalln(s...)
+	slog.Error(logMsg(s...))
+	os.Exit(1)
 }
 
-// MyLogger sets up a custom logger, if filename is given, emitting to stdout as well
-// If filename is blank string, then output is stdout only
-func MyLogger(filename string) {
-	if filename != "" {
-		log.SetOutput(&lumberjack.Logger{
-			Filename: filename,
-			MaxAge:   7,    //days
-			Compress: true, // disabled by default
-		})
+// LogConfig holds the logging settings, usually from command-line flags
+type LogConfig struct {
+	Filename   string     // if blank, logs go to stderr
+	Level      slog.Level // lowest level logged
+	JSON       bool       // JSON lines, rather than key=value text
+	MaxSize    int        // megabytes written to the file before it is rotated
+	MaxAge     int        // days to keep rotated files
+	MaxBackups int        // rotated files to keep; 0 keeps all
+}
+
+// LogFlags defines the logging flags in fs, returning the settings they will be parsed into
+func LogFlags(fs *flag.FlagSet) *LogConfig {
+	c := &LogConfig{}
+	fs.StringVar(&c.Filename, "logfile", "", "File written with message logs")
+	fs.TextVar(&c.Level, "log_level", slog.LevelInfo, "Lowest level of message logged: debug, info, warn or error")
+	fs.BoolVar(&c.JSON, "log_json", false, "Write logs as JSON lines")
+	fs.IntVar(&c.MaxSize, "log_max_size", 100, "Megabytes written to logfile before it is rotated")
+	fs.IntVar(&c.MaxAge, "log_max_age", 7, "Days to keep rotated logfiles")
+	fs.IntVar(&c.MaxBackups, "log_max_backups", 0, "Number of rotated logfiles to keep (0 keeps all, up to log_max_age)")
+	return c
+}
+
+// SetupLogging sets the default structured logger from c. Output from the standard log package goes to the same place, at info level.
+func SetupLogging(c LogConfig) {
+	var w io.Writer = os.Stderr
+	if c.Filename != "" {
+		w = &lumberjack.Logger{
+			Filename:   c.Filename,
+			MaxSize:    c.MaxSize,
+			MaxAge:     c.MaxAge,
+			MaxBackups: c.MaxBackups,
+			Compress:   true, // disabled by default
+		}
+	}
+	opts := &slog.HandlerOptions{Level: c.Level}
+	var h slog.Handler
+	if c.JSON {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
 	}
+	slog.SetDefault(slog.New(h))
+}
+
+// MyLogger sets up logging to filename, kept for 7 days. If filename is blank string, then output is to stderr.
+func MyLogger(filename string) {
+	SetupLogging(LogConfig{Filename: filename, MaxAge: 7})
+}
+
+// logMsg formats args as log.Println does, without the newline
+func logMsg(args ...interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(args...), "\n")
 }
 
 // GetenvDefault returns an environment variable, with default if unset
@@ -77,7 +122,7 @@ func SafeStringToInt(s string) int {
 	}
 	i, err := strconv.Atoi(s)
 	if err != nil {
-		log.Println("Warning: cannot convert", s, "to int")
+		slog.Warn("Cannot convert to int", "value", s)
 		i = 0
 	}
 	return i
@@ -88,6 +133,9 @@ func SafeStringToInt(s string) int {
 // RedisQueue connects the tracker and feeder tasks
 const RedisQueue = "trk_queue"
 
+// RedisRetryQueue holds events the feeder took from RedisQueue but could not send, to be taken again first
+const RedisRetryQueue = "trk_queue_retry"
+
 // RedisAcctHeaders holds the PowerMTA accounting file headers
 const RedisAcctHeaders = "acct_headers"
 
@@ -1,9 +1,14 @@
 package sparkypmtatracking_test
 
 import (
+	"encoding/json"
 	"errors"
+	"flag"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"os"
+	"strings"
 	"testing"
 
 	spmta "github.com/tuck1s/sparkypmtatracking"
@@ -18,6 +23,44 @@ func TestMyLogger(t *testing.T) {
 	log.Println(s)
 }
 
+func TestSetupLogging(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c := spmta.LogFlags(fs)
+	f := "common_test_json.log"
+	defer os.Remove(f)
+	if err := fs.Parse([]string{"-logfile", f, "-log_level", "warn", "-log_json", "-log_max_size", "5"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := spmta.LogConfig{Filename: f, Level: slog.LevelWarn, JSON: true, MaxSize: 5, MaxAge: 7}
+	if *c != expected {
+		t.Errorf("Got %+v, expected %+v", *c, expected)
+	}
+	spmta.SetupLogging(*c)
+	defer spmta.SetupLogging(spmta.LogConfig{})
+	slog.Info("Not logged at this level")
+	slog.Warn("Something to log", "message_id", "0000123456789abcdef0")
+
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one line, got %q", b)
+	}
+	var entry map[string]interface{}
+	if err = json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["level"] != "WARN" || entry["msg"] != "Something to log" || entry["message_id"] != "0000123456789abcdef0" {
+		t.Errorf("Unexpected log entry %v", entry)
+	}
+
+	if err = fs.Parse([]string{"-log_level", "loud"}); err == nil {
+		t.Errorf("Expected error from invalid log level")
+	}
+}
+
 func Test_GetenvDefault(t *testing.T) {
 	vname := "some_weird_env_variable42"
 	blank := "---"
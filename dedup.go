@@ -0,0 +1,90 @@
+package sparkypmtatracking
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// DedupPrefix is the prefix for Redis keys marking events already seen, for de-duplication
+const DedupPrefix = "dedup_"
+
+// Dedup drops repeated events, such as pixels fetched again by the mail client, or double-clicks
+type Dedup struct {
+	Window        time.Duration // The same action on the same link of a message, within this time, is a duplicate
+	FirstOpenOnly bool          // Pass on only the first open (or initial_open) of each message, however much later others come
+}
+
+// Duplicate returns true if e has been seen before, in another queue entry. The first time an event is seen, it is
+// marked in Redis with SET NX, holding entry (the ID of the queue entry it came from) and the time of the event. Later
+// events are duplicates if they happened within the window of that time, however late they are taken from the queue,
+// e.g. after a backlog. An event taken again from the same entry, e.g. because its batch could not be sent, is not a
+// duplicate. Events without a message ID are never duplicates.
+func (d *Dedup) Duplicate(client *redis.Client, e *SparkPostEvent, entry string) (bool, error) {
+	key, window := d.key(e)
+	if key == "" {
+		return false, nil
+	}
+	at := EventTime(e)
+	ttl := MsgIDTTL
+	if window > 0 {
+		// Keep the mark until the window has passed, counting from when the event happened
+		ttl = window
+		if lag := time.Since(at); lag > 0 {
+			ttl += lag
+		}
+	}
+	mark := entry + " " + strconv.FormatInt(at.Unix(), 10)
+	first, err := client.SetNX(key, mark, ttl).Result()
+	if err != nil || first {
+		return false, err
+	}
+	seen, err := client.Get(key).Result()
+	if err == redis.Nil {
+		return false, nil // expired since
+	}
+	if err != nil {
+		return false, err
+	}
+	seenIn, seenAt := parseDedupMark(seen, at)
+	if seenIn == entry {
+		return false, nil
+	}
+	if window > 0 && (at.Sub(seenAt) >= window || seenAt.Sub(at) >= window) {
+		// Outside the window of the event seen, so this one starts a new window
+		return false, client.Set(key, mark, ttl).Err()
+	}
+	FeedDuplicates.WithLabelValues(e.EventWrapper.EventGrouping.Type).Inc()
+	return true, nil
+}
+
+// parseDedupMark returns the queue entry and event time held in a dedup key. A mark without a time is taken as at.
+func parseDedupMark(mark string, at time.Time) (string, time.Time) {
+	entry, ts, _ := strings.Cut(mark, " ")
+	if t, err := strconv.ParseInt(ts, 10, 64); err == nil {
+		at = time.Unix(t, 0)
+	}
+	return entry, at
+}
+
+// key returns the Redis key marking e as seen, and the window in which repeats are duplicates (0 for any time),
+// or "" if e is not de-duplicated
+func (d *Dedup) key(e *SparkPostEvent) (string, time.Duration) {
+	g := &e.EventWrapper.EventGrouping
+	if g.MessageID == "" {
+		return "", 0
+	}
+	if d.FirstOpenOnly && (g.Type == "open" || g.Type == "initial_open") {
+		return DedupPrefix + g.MessageID + ":open", 0
+	}
+	if d.Window <= 0 {
+		return "", 0
+	}
+	// Keep keys short, whatever the length of the link
+	sum := sha256.Sum256([]byte(g.TargetLinkURL))
+	return DedupPrefix + g.MessageID + ":" + g.Type + ":" + hex.EncodeToString(sum[:8]), d.Window
+}
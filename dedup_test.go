@@ -0,0 +1,154 @@
+package sparkypmtatracking_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+func TestDedup(t *testing.T) {
+	client := spmta.MyRedis()
+	now := time.Now()
+	msgID := spmta.UniqMessageID()
+	click := archiveEvent("click", msgID, "bob@example.com", now)
+	otherClick := archiveEvent("click", msgID, "bob@example.com", now)
+	otherClick.EventWrapper.EventGrouping.TargetLinkURL = testURL + "?page=2"
+	open := archiveEvent("open", msgID, "bob@example.com", now)
+	initialOpen := archiveEvent("initial_open", msgID, "bob@example.com", now)
+	noID := archiveEvent("click", "", "bob@example.com", now)
+
+	d := spmta.Dedup{Window: time.Minute}
+	clicksBefore := testutil.ToFloat64(spmta.FeedDuplicates.WithLabelValues("click"))
+	for i, c := range []struct {
+		e     spmta.SparkPostEvent
+		entry string
+		want  bool
+	}{
+		{click, "1", false},
+		{click, "2", true},
+		{click, "1", false}, // the same entry taken again, e.g. after its batch failed
+		{otherClick, "3", false},
+		{open, "4", false},
+		{initialOpen, "5", false},
+		{noID, "6", false},
+		{noID, "7", false},
+	} {
+		dup, err := d.Duplicate(client, &c.e, c.entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dup != c.want {
+			t.Errorf("Event %d: got duplicate %v, want %v", i, dup, c.want)
+		}
+	}
+	if got := testutil.ToFloat64(spmta.FeedDuplicates.WithLabelValues("click")) - clicksBefore; got != 1 {
+		t.Errorf("Expected 1 duplicate click counted, got %v", got)
+	}
+
+	// The window is from when the events happened, not when they are taken from the queue
+	msgID = spmta.UniqMessageID()
+	hourAgo := now.Add(-time.Hour)
+	for i, c := range []struct {
+		at   time.Time
+		want bool
+	}{
+		{hourAgo, false},
+		{hourAgo.Add(30 * time.Second), true},
+		{hourAgo.Add(2 * time.Minute), false}, // outside the window, so starts a new one
+		{hourAgo.Add(150 * time.Second), true},
+		{hourAgo.Add(-time.Minute), false},
+	} {
+		e := archiveEvent("click", msgID, "bob@example.com", c.at)
+		dup, err := d.Duplicate(client, &e, fmt.Sprint("late", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dup != c.want {
+			t.Errorf("Late event %d: got duplicate %v, want %v", i, dup, c.want)
+		}
+	}
+
+	// With first open only, an initial_open and later opens all count as the same open
+	msgID = spmta.UniqMessageID()
+	initialOpen = archiveEvent("initial_open", msgID, "bob@example.com", now)
+	open = archiveEvent("open", msgID, "bob@example.com", now.Add(time.Hour))
+	d = spmta.Dedup{FirstOpenOnly: true}
+	for i, e := range []spmta.SparkPostEvent{initialOpen, open, open} {
+		dup, err := d.Duplicate(client, &e, fmt.Sprint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dup != (i > 0) {
+			t.Errorf("Open %d: got duplicate %v", i, dup)
+		}
+	}
+	// Clicks are kept, as there is no window
+	click = archiveEvent("click", msgID, "bob@example.com", now)
+	for i := 0; i < 2; i++ {
+		if dup, err := d.Duplicate(client, &click, fmt.Sprint(i)); dup || err != nil {
+			t.Errorf("Unexpected %v %v", dup, err)
+		}
+	}
+}
+
+// The feeder sends only the first of repeated events
+func TestFeederDedup(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisQueue(client)
+	e := testEvent(spmta.UniqMessageID())
+	eBytes, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = client.RPush(spmta.RedisQueue, eBytes).Result(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out bytes.Buffer
+	f := spmta.Feeder{Client: client, Sink: &spmta.StdoutSink{W: &out}, Dedup: &spmta.Dedup{Window: time.Minute}}
+	if err = f.FeedEvents(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(out.Bytes(), []byte("\n")); n != 1 {
+		t.Errorf("Expected 1 event sent, got %d: %s", n, out.String())
+	}
+}
+
+// With first open only, an open that could not be sent is still sent by the feeder that claims it
+func TestFeederDedupClaimed(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisStream(t, client)
+	e := testEvent(spmta.UniqMessageID())
+	e.WD.Action = "o"
+	eBytes, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.XAdd(&redis.XAddArgs{Stream: spmta.RedisStream, Values: map[string]interface{}{"event": eBytes}}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	const claimAfter = 100 * time.Millisecond
+	d := &spmta.Dedup{FirstOpenOnly: true}
+
+	dead := spmta.Feeder{Client: client, Sink: failSink{}, Consumer: "feeder-dead", ClaimAfter: claimAfter, Dedup: d}
+	if err = dead.FeedEvents(context.Background()); err == nil {
+		t.Fatal("Expected sink error")
+	}
+	time.Sleep(claimAfter)
+	var sink batchSink
+	alive := spmta.Feeder{Client: client, Sink: &sink, Consumer: "feeder-alive", ClaimAfter: claimAfter, Dedup: d}
+	if err = alive.FeedEvents(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(sink.sizes); got != "[1]" {
+		t.Errorf("Got batches %s", got)
+	}
+}
@@ -0,0 +1,146 @@
+package sparkypmtatracking
+
+import (
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// EngagementPrefix is the prefix for Redis hashes counting the opens and clicks seen for each message
+const EngagementPrefix = "engagement_"
+
+// EngagedPrefix is the prefix for Redis keys marking the queue entries already counted in an engagement hash
+const EngagedPrefix = "engaged_"
+
+// engagedTTL is how long a queue entry is remembered as counted, long enough for it to be taken again, e.g. after its
+// batch failed, or when claimed from another feeder
+const engagedTTL = 24 * time.Hour
+
+// Fields of the engagement hash. Clicks on each link are counted in field "click:" followed by the link URL. Each
+// counted field also has a field "first:" followed by its name, holding the queue entry that counted first.
+const (
+	engagementOpens  = "open"
+	engagementClicks = "click"
+)
+
+// recordEngagement counts e, taken from queue entry, in the engagement record of its message, and flags whether it
+// is the first open, first click, or first click on its link. An entry taken again, e.g. because its batch could not
+// be sent, is not counted again, and gets the same flags. Events without a message ID are not flagged.
+func recordEngagement(client *redis.Client, e *SparkPostEvent, entry string) error {
+	g := &e.EventWrapper.EventGrouping
+	if g.MessageID == "" {
+		return nil
+	}
+	var fields []string
+	switch g.Type {
+	case "open", "initial_open":
+		fields = []string{engagementOpens}
+	case "click":
+		fields = []string{engagementClicks, engagementClicks + ":" + g.TargetLinkURL}
+	default:
+		return nil
+	}
+	key := EngagementPrefix + g.MessageID
+	pipe := client.TxPipeline()
+	counted := pipe.SetNX(EngagedPrefix+entry, 1, engagedTTL)
+	firstSet := make([]*redis.BoolCmd, len(fields))
+	for i, f := range fields {
+		pipe.HIncrBy(key, f, 1)
+		firstSet[i] = pipe.HSetNX(key, "first:"+f, entry)
+	}
+	pipe.Expire(key, MsgIDTTL)
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+	first := make([]*bool, len(fields))
+	for i, c := range firstSet {
+		f := c.Val()
+		first[i] = &f
+	}
+	if !counted.Val() {
+		// Counted before; taking an entry again is rare, so undo the count rather than check first. The entry keeps
+		// the flags it was first given.
+		pipe = client.TxPipeline()
+		firstBy := make([]*redis.StringCmd, len(fields))
+		for i, f := range fields {
+			pipe.HIncrBy(key, f, -1)
+			firstBy[i] = pipe.HGet(key, "first:"+f)
+		}
+		if _, err := pipe.Exec(); err != nil {
+			return err
+		}
+		for i, c := range firstBy {
+			*first[i] = c.Val() == entry
+		}
+	}
+	if g.Type == "click" {
+		g.FirstClick, g.FirstLinkClick = first[0], first[1]
+	} else {
+		g.FirstOpen = first[0]
+	}
+	return nil
+}
+
+// MessageSummary totals the opens and clicks of one message. The first open and click times are only known if
+// the summary included the events flagged as first.
+type MessageSummary struct {
+	MessageID    string     `json:"message_id"`
+	RcptTo       string     `json:"rcpt_to"`
+	Opens        int        `json:"opens"`
+	Clicks       int        `json:"clicks"`
+	LinksClicked int        `json:"links_clicked"` // different links clicked
+	FirstOpen    *time.Time `json:"first_open,omitempty"`
+	FirstClick   *time.Time `json:"first_click,omitempty"`
+}
+
+// EngagementSummary totals events by message, e.g. those found in the archive
+type EngagementSummary struct {
+	messages map[string]*MessageSummary
+}
+
+// Add counts e in the summary. Events without a message ID are ignored.
+func (s *EngagementSummary) Add(e *SparkPostEvent) {
+	g := &e.EventWrapper.EventGrouping
+	if g.MessageID == "" {
+		return
+	}
+	if s.messages == nil {
+		s.messages = make(map[string]*MessageSummary)
+	}
+	m, found := s.messages[g.MessageID]
+	if !found {
+		m = &MessageSummary{MessageID: g.MessageID}
+		s.messages[g.MessageID] = m
+	}
+	if m.RcptTo == "" {
+		m.RcptTo = g.RcptTo
+	}
+	switch g.Type {
+	case "open", "initial_open":
+		m.Opens++
+		if g.FirstOpen != nil && *g.FirstOpen {
+			t := EventTime(e).UTC()
+			m.FirstOpen = &t
+		}
+	case "click":
+		m.Clicks++
+		if g.FirstClick != nil && *g.FirstClick {
+			t := EventTime(e).UTC()
+			m.FirstClick = &t
+		}
+		if g.FirstLinkClick != nil && *g.FirstLinkClick {
+			m.LinksClicked++
+		}
+	}
+}
+
+// Messages returns the summary of each message, ordered by message ID
+func (s *EngagementSummary) Messages() []*MessageSummary {
+	msgs := make([]*MessageSummary, 0, len(s.messages))
+	for _, m := range s.messages {
+		msgs = append(msgs, m)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].MessageID < msgs[j].MessageID })
+	return msgs
+}
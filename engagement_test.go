@@ -0,0 +1,179 @@
+package sparkypmtatracking_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+// firstFlag returns the value of a first_ flag, or "-" if not set
+func firstFlag(b *bool) string {
+	if b == nil {
+		return "-"
+	}
+	return fmt.Sprint(*b)
+}
+
+// ingestSink records the NDJSON of each batch sent to it, as sent to the Ingest API
+type ingestSink struct {
+	ndjson []byte
+}
+
+func (s *ingestSink) Name() string { return "ingest" }
+
+func (s *ingestSink) Send(ctx context.Context, b *spmta.EventBatch) error {
+	s.ndjson = append(s.ndjson, b.NDJSON...)
+	return nil
+}
+
+func (s *ingestSink) Close() error { return nil }
+
+// feedFlags sends the events on the queue through a feeder, and returns the first_ flags of each. The flags are not
+// sent to the Ingest API.
+func feedFlags(t *testing.T, f spmta.Feeder) []string {
+	var out bytes.Buffer
+	var ingest ingestSink
+	f.Sink = spmta.MultiSink{&spmta.StdoutSink{W: &out}, &ingest}
+	if err := f.FeedEvents(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(ingest.ndjson, []byte("first_")) {
+		t.Errorf("Flags sent in Ingest format %s", ingest.ndjson)
+	}
+	var flags []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var sp spmta.SparkPostEvent
+		if err := json.Unmarshal([]byte(line), &sp); err != nil {
+			t.Fatal(err)
+		}
+		g := &sp.EventWrapper.EventGrouping
+		flags = append(flags, firstFlag(g.FirstOpen)+" "+firstFlag(g.FirstClick)+" "+firstFlag(g.FirstLinkClick))
+	}
+	return flags
+}
+
+func TestFirstOpenClickFlags(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisQueue(client)
+	msgID := spmta.UniqMessageID()
+	cases := []struct {
+		action, url string
+		want        string // first_open first_click first_link_click
+	}{
+		{"i", "", "true - -"},
+		{"o", "", "false - -"},
+		{"c", testURL, "- true true"},
+		{"c", testURL, "- false false"},
+		{"c", testURL + "?page=2", "- false true"},
+		{"o", "", "false - -"},
+	}
+	for _, c := range cases {
+		e := testEvent(msgID)
+		e.WD.Action, e.WD.TargetLinkURL = c.action, c.url
+		eBytes, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = client.RPush(spmta.RedisQueue, eBytes).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flags := feedFlags(t, spmta.Feeder{Client: client})
+	if len(flags) != len(cases) {
+		t.Fatalf("Expected %d events, got %v", len(cases), flags)
+	}
+	for i, c := range cases {
+		if flags[i] != c.want {
+			t.Errorf("Event %d: got flags %s, want %s", i, flags[i], c.want)
+		}
+	}
+	if ttl := client.TTL(spmta.EngagementPrefix + msgID).Val(); ttl <= 0 || ttl > spmta.MsgIDTTL {
+		t.Errorf("Unexpected engagement record TTL %v", ttl)
+	}
+	if n := client.HGet(spmta.EngagementPrefix+msgID, "open").Val(); n != "3" {
+		t.Errorf("Expected 3 opens counted, got %s", n)
+	}
+	// The entries counted are marked in their own keys, so the record does not grow with each event
+	if n := client.HLen(spmta.EngagementPrefix + msgID).Val(); n != 8 {
+		t.Errorf("Expected 8 fields in the engagement record, got %v", client.HKeys(spmta.EngagementPrefix+msgID).Val())
+	}
+}
+
+// An event claimed after its batch failed is counted once, and keeps its first_ flags. Duplicates are not counted.
+func TestFirstOpenClaimed(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisStream(t, client)
+	msgID := spmta.UniqMessageID()
+	e := testEvent(msgID)
+	e.WD.Action = "o"
+	eBytes, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = client.XAdd(&redis.XAddArgs{Stream: spmta.RedisStream, Values: map[string]interface{}{"event": eBytes}}).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const claimAfter = 100 * time.Millisecond
+	d := &spmta.Dedup{FirstOpenOnly: true}
+	dead := spmta.Feeder{Client: client, Sink: failSink{}, Consumer: "feeder-dead", ClaimAfter: claimAfter, Dedup: d}
+	if err = dead.FeedEvents(context.Background()); err == nil {
+		t.Fatal("Expected sink error")
+	}
+	time.Sleep(claimAfter)
+	flags := feedFlags(t, spmta.Feeder{Client: client, Consumer: "feeder-alive", ClaimAfter: claimAfter, Dedup: d})
+	if fmt.Sprint(flags) != "[true - -]" {
+		t.Errorf("Unexpected flags %v", flags)
+	}
+	if n := client.HGet(spmta.EngagementPrefix+msgID, "open").Val(); n != "1" {
+		t.Errorf("Expected 1 open counted, got %s", n)
+	}
+}
+
+func TestEngagementSummary(t *testing.T) {
+	yes, no := true, false
+	t0 := time.Date(2020, 1, 7, 16, 0, 0, 0, time.UTC)
+	var events []spmta.SparkPostEvent
+	add := func(typ, msgID string, at time.Time, first, firstLink *bool) {
+		e := archiveEvent(typ, msgID, "bob@example.com", at)
+		g := &e.EventWrapper.EventGrouping
+		if typ == "click" {
+			g.FirstClick, g.FirstLinkClick = first, firstLink
+		} else {
+			g.FirstOpen = first
+		}
+		events = append(events, e)
+	}
+	add("initial_open", "m2", t0, &yes, nil)
+	add("open", "m2", t0.Add(time.Hour), &no, nil)
+	add("click", "m2", t0.Add(2*time.Hour), &yes, &yes)
+	add("click", "m2", t0.Add(3*time.Hour), &no, &no)
+	add("click", "m2", t0.Add(4*time.Hour), &no, &yes)
+	add("open", "m1", t0, &no, nil) // first open not included
+	add("open", "", t0, nil, nil)
+
+	var s spmta.EngagementSummary
+	for i := range events {
+		s.Add(&events[i])
+	}
+	msgs := s.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+	m1, m2 := msgs[0], msgs[1]
+	if m1.MessageID != "m1" || m1.Opens != 1 || m1.Clicks != 0 || m1.FirstOpen != nil || m1.FirstClick != nil {
+		t.Errorf("Unexpected m1 summary %+v", m1)
+	}
+	if m2.MessageID != "m2" || m2.RcptTo != "bob@example.com" || m2.Opens != 2 || m2.Clicks != 3 || m2.LinksClicked != 2 ||
+		m2.FirstOpen == nil || !m2.FirstOpen.Equal(t0) || m2.FirstClick == nil || !m2.FirstClick.Equal(t0.Add(2*time.Hour)) {
+		t.Errorf("Unexpected m2 summary %+v", m2)
+	}
+}
@@ -1,13 +1,15 @@
 package sparkypmtatracking
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 
 	"github.com/go-redis/redis"
 	"github.com/smartystreets/scanners/csv"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Scan input accounting records - required fields for augmentation are: type, header_x-sp-message-id.
@@ -28,7 +30,7 @@ var optionalAcctFields = []string{
 //   Checks for required and optional fields.
 //   Writes these into persistent storage, so that we can decode "d" records in future, separate process invocations.
 func StoreHeaders(r []string, client *redis.Client) error {
-	log.Printf("PowerMTA accounting headers: %v\n", r)
+	slog.Info("PowerMTA accounting headers", "fields", r)
 	hdrs := make(map[string]int)
 	for _, f := range requiredAcctFields {
 		fpos, found := PositionIn(r, f)
@@ -53,27 +55,34 @@ func StoreHeaders(r []string, client *redis.Client) error {
 	if err != nil {
 		return err
 	}
-	log.Println("Loaded", RedisAcctHeaders, "->", string(hdrsJSON), "into Redis")
+	slog.Info("Loaded into Redis", "key", RedisAcctHeaders, "value", string(hdrsJSON))
 	return nil
 }
 
 // StoreEvent puts a single accounting event r into redis, based on previously seen header format
 func StoreEvent(r []string, client *redis.Client) error {
+	_, err := storeEvent(r, client)
+	return err
+}
+
+// storeEvent is StoreEvent, also returning the event's message ID if it was found
+func storeEvent(r []string, client *redis.Client) (string, error) {
 	hdrsJ, err := client.Get(RedisAcctHeaders).Result()
 	if err == redis.Nil {
-		return fmt.Errorf("Redis key %v not found", RedisAcctHeaders)
+		return "", fmt.Errorf("Redis key %v not found", RedisAcctHeaders)
 	}
 	hdrs := make(map[string]int)
 	err = json.Unmarshal([]byte(hdrsJ), &hdrs)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// read fields into a message_id-specific redis key
 	msgIDindex, ok := hdrs[msgIDField]
 	if !ok {
-		return fmt.Errorf("Redis key %v is missing field header_x-sp-message-id", RedisAcctHeaders)
+		return "", fmt.Errorf("Redis key %v is missing field header_x-sp-message-id", RedisAcctHeaders)
 	}
-	msgIDKey := TrackingPrefix + r[msgIDindex]
+	msgID := r[msgIDindex]
+	msgIDKey := TrackingPrefix + msgID
 	augment := make(map[string]string)
 	for k, i := range hdrs {
 		if k != msgIDField && k != typeField {
@@ -83,14 +92,14 @@ func StoreEvent(r []string, client *redis.Client) error {
 	// Set key message_id in Redis
 	augmentJSON, err := json.Marshal(augment)
 	if err != nil {
-		return err
+		return msgID, err
 	}
 	_, err = client.Set(msgIDKey, augmentJSON, MsgIDTTL).Result()
 	if err != nil {
-		return err
+		return msgID, err
 	}
-	log.Printf("Loaded %s -> %s into Redis\n", msgIDKey, string(augmentJSON))
-	return nil
+	slog.Info("Loaded into Redis", "message_id", msgID, "key", msgIDKey, "value", string(augmentJSON))
+	return msgID, nil
 }
 
 // AccountETL extracts, transforms accounting data from PowerMTA into Redis records
@@ -100,20 +109,32 @@ func AccountETL(f io.Reader) error {
 	for input.Scan() {
 		r := input.Record()
 		if len(r) < len(requiredAcctFields) {
+			ETLErrors.Inc()
 			return fmt.Errorf("Insufficient data fields %v", r)
 		}
+		_, span := tracer.Start(context.Background(), "acct_etl.record")
+		var err error
+		var kind string
 		switch r[0] {
 		case deliveryType:
-			if err := StoreEvent(r, client); err != nil {
-				return err
+			var msgID string
+			msgID, err = storeEvent(r, client)
+			kind = "delivery"
+			if msgID != "" {
+				span.SetAttributes(MessageIDAttr.String(msgID))
 			}
 		case typeField:
-			if err := StoreHeaders(r, client); err != nil {
-				return err
-			}
+			err, kind = StoreHeaders(r, client), "header"
 		default:
-			return fmt.Errorf("Accounting record not of expected type: %v", r)
+			err = fmt.Errorf("Accounting record not of expected type: %v", r)
+		}
+		span.SetAttributes(attribute.String("record.type", kind))
+		endSpan(span, err)
+		if err != nil {
+			ETLErrors.Inc()
+			return err
 		}
+		ETLRecords.WithLabelValues(kind).Inc()
 	}
 	return nil
 }
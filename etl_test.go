@@ -4,6 +4,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	spmta "github.com/tuck1s/sparkypmtatracking"
 )
 
@@ -28,9 +29,17 @@ func loadCSVandCheckError(t *testing.T, csv string) {
 }
 
 func TestAccountETL(t *testing.T) {
+	headers := testutil.ToFloat64(spmta.ETLRecords.WithLabelValues("header"))
+	deliveries := testutil.ToFloat64(spmta.ETLRecords.WithLabelValues("delivery"))
 	loadCSVandCheckError(t, exampleCSV)
 	loadCSVandCheckError(t, "\n")                            // empty file, should read OK
 	loadCSVandCheckError(t, validMinimalHeader+"d,f00dbeef") // small input
+	if got := testutil.ToFloat64(spmta.ETLRecords.WithLabelValues("header")) - headers; got != 2 {
+		t.Errorf("Expected 2 header records counted, got %v", got)
+	}
+	if got := testutil.ToFloat64(spmta.ETLRecords.WithLabelValues("delivery")) - deliveries; got != 4 {
+		t.Errorf("Expected 4 delivery records counted, got %v", got)
+	}
 }
 
 // checks err contains a substring of an "expected" error
@@ -43,6 +52,7 @@ func checkExpectedError(t *testing.T, err error, s string) {
 }
 
 func TestAccountETLFaultyInputs(t *testing.T) {
+	errorsBefore := testutil.ToFloat64(spmta.ETLErrors)
 	// missing required header field
 	err := loadCSV("type,rcpt\n" + "d,wilma@flintstone.org")
 	checkExpectedError(t, err, "header_x-sp-message-id is not present")
@@ -54,6 +64,9 @@ func TestAccountETLFaultyInputs(t *testing.T) {
 	// missing data
 	err = loadCSV("type\n" + "d")
 	checkExpectedError(t, err, "Insufficient data fields")
+	if got := testutil.ToFloat64(spmta.ETLErrors) - errorsBefore; got != 3 {
+		t.Errorf("Expected 3 errors counted, got %v", got)
+	}
 }
 
 func TestAccountETLFaultyStoredHeader(t *testing.T) {
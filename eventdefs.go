@@ -34,6 +34,11 @@ type SparkPostEvent struct {
 			TargetLinkURL string `json:"target_link_url"`
 			UserAgent     string `json:"user_agent"`
 			SubaccountID  int    `json:"subaccount_id"`
+			// Set by the feeder from the opens and clicks it has seen for the message. Not part of the Ingest API
+			// format, so left out of the NDJSON sent there.
+			FirstOpen      *bool `json:"first_open,omitempty"`       // opens: the first open of the message
+			FirstClick     *bool `json:"first_click,omitempty"`      // clicks: the first click on any link in the message
+			FirstLinkClick *bool `json:"first_link_click,omitempty"` // clicks: the first click on this link
 		} `json:"track_event"`
 	} `json:"msys"`
 }
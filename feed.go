@@ -4,17 +4,22 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Make a SparkPost formatted unique event_id, which needs to be a decimal string 0 .. (2^63-1)
@@ -24,6 +29,14 @@ func uniqEventID() string {
 	return strconv.FormatUint(num, 10)
 }
 
+// entryEventID makes a SparkPost event_id from the ID of the queue entry holding the event, so an event sent again,
+// e.g. after its batch failed, keeps the same event_id
+func entryEventID(entry string) string {
+	sum := sha256.Sum256([]byte(entry))
+	num := binary.LittleEndian.Uint64(sum[:8]) & 0x7fffffffffffffff
+	return strconv.FormatUint(num, 10)
+}
+
 // makeSparkPostEvent takes a raw Redis queue entry and forms a SparkPostEvent structure
 func makeSparkPostEvent(eStr string, client *redis.Client) (SparkPostEvent, error) {
 	var tev TrackEvent
@@ -43,7 +56,9 @@ func makeSparkPostEvent(eStr string, client *redis.Client) (SparkPostEvent, erro
 	// Augment with PowerMTA accounting-pipe values, if we have these, from persistent storage
 	tKey := TrackingPrefix + tev.WD.MessageID
 	if augmentJSON, err := client.Get(tKey).Result(); err == redis.Nil {
-		log.Println("Warning: redis key", tKey, "not found, url=", tev.WD.TargetLinkURL)
+		slog.Warn("Redis key not found", "key", tKey, "message_id", tev.WD.MessageID, "url", tev.WD.TargetLinkURL)
+	} else if err != nil {
+		return spEvent, err
 	} else {
 		augment := make(map[string]string)
 		err = json.Unmarshal([]byte(augmentJSON), &augment)
@@ -68,19 +83,43 @@ func SparkPostEventNDJSON(eStr string, client *redis.Client) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	eJSON, err := json.Marshal(e)
+	return eventNDJSON(&e)
+}
+
+// invalidJSON returns true if err is a failure to unmarshal JSON, which won't go away by trying again
+func invalidJSON(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
+
+// eventNDJSON formats e as a line of NDJSON, in SparkPost Ingest format, which has no first open and click flags
+func eventNDJSON(e *SparkPostEvent) ([]byte, error) {
+	ingest := *e
+	g := &ingest.EventWrapper.EventGrouping
+	g.FirstOpen, g.FirstClick, g.FirstLinkClick = nil, nil, nil
+	eJSON, err := json.Marshal(ingest)
 	if err != nil {
 		return nil, err
 	}
-	eJSON = append(eJSON, byte('\n'))
-	return eJSON, nil
+	return append(eJSON, byte('\n')), nil
 }
 
 // SparkPostIngest POSTs a batch of ingestData to SparkPost Ingest API
 func SparkPostIngest(ingestData []byte, client *redis.Client, host string, apiKey string) error {
+	return sparkPostIngest(context.Background(), ingestData, nil, host, apiKey)
+}
+
+// sparkPostIngest POSTs a batch of ingestData, holding events for msgIDs, to SparkPost Ingest API, in a trace span
+func sparkPostIngest(ctx context.Context, ingestData []byte, msgIDs []string, host string, apiKey string) (err error) {
+	ctx, span := tracer.Start(ctx, "SparkPostIngest", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Int("ingest.bytes", len(ingestData)), attribute.Int("ingest.events", len(msgIDs)),
+			attribute.StringSlice("message_ids", msgIDs)))
+	defer func() { endSpan(span, err) }()
+
 	var zbuf bytes.Buffer
 	zw := gzip.NewWriter(&zbuf)
-	_, err := zw.Write(ingestData)
+	_, err = zw.Write(ingestData)
 	if err != nil {
 		return err
 	}
@@ -96,7 +135,7 @@ func SparkPostIngest(ingestData []byte, client *redis.Client, host string, apiKe
 		Timeout: time.Second * 300,
 	}
 	url := host + "/api/v1/ingest/events"
-	req, err := http.NewRequest("POST", url, zr)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, zr)
 	if err != nil {
 		return err
 	}
@@ -109,6 +148,7 @@ func SparkPostIngest(ingestData []byte, client *redis.Client, host string, apiKe
 	if err != nil {
 		return err
 	}
+	span.SetAttributes(attribute.Int("ingest.gzip_bytes", gzipSize), attribute.Int("http.response.status_code", res.StatusCode))
 	// Response body is a Reader; read it into []byte
 	responseBody, err := ioutil.ReadAll(res.Body)
 	if err != nil {
@@ -121,13 +161,12 @@ func SparkPostIngest(ingestData []byte, client *redis.Client, host string, apiKe
 	}
 	if resObj.Errors != nil && len(resObj.Errors) > 0 {
 		errStr := resObj.Errors[0].Message
-		log.Printf("Uploaded %d bytes raw, %d bytes gzipped. SparkPost response: %s, errors[0]= %s\n",
-			len(ingestData), gzipSize, res.Status, errStr)
+		slog.Warn("Ingest API error", "bytes", len(ingestData), "gzip_bytes", gzipSize, "status", res.Status, "error", errStr)
 		return errors.New(errStr)
 	}
 	if resObj.Results.ID != "" {
-		log.Printf("Uploaded %d bytes raw, %d bytes gzipped. SparkPost Ingest response: %s, results.id=%s\n",
-			len(ingestData), gzipSize, res.Status, resObj.Results.ID)
+		span.SetAttributes(attribute.String("ingest.batch_id", resObj.Results.ID))
+		slog.Info("Uploaded batch", "bytes", len(ingestData), "gzip_bytes", gzipSize, "status", res.Status, "batch_id", resObj.Results.ID)
 	}
 	err = res.Body.Close()
 	return err
@@ -136,8 +175,11 @@ func SparkPostIngest(ingestData []byte, client *redis.Client, host string, apiKe
 // TimedBuffer associates content with a time started and a maximum age it should be held for
 type TimedBuffer struct {
 	Content     []byte
+	Events      []SparkPostEvent // the events held in Content
 	TimeStarted time.Time
 	MaxAge      time.Duration
+	ids         []string // queue entries of the events, to acknowledge once sent
+	entries     []string // the raw queue entries, to put back if they can't be sent
 }
 
 // AgedContent returns true if the buffer has non-nil contents that are older than the specified maxAge
@@ -146,50 +188,329 @@ func (t *TimedBuffer) AgedContent() bool {
 	return len(t.Content) > 0 && age >= t.MaxAge
 }
 
+// FeedDefaultPollInterval is the longest the feeder waits for an event, before checking whether to send the batch
+// it has, or stop
+const FeedDefaultPollInterval = time.Second
+
+// Feeder takes events from the Redis queue and sends them to an event sink in batches. With Consumer set, feeders
+// read the Redis stream as a consumer group instead, so several can share the events.
+type Feeder struct {
+	Client       *redis.Client
+	Sink         EventSink
+	MaxAge       time.Duration // Longest time to hold events before sending them. 0 sends whenever the queue is empty
+	MaxBytes     int           // Batches are kept smaller than this many bytes of NDJSON. Default SparkPostIngestMaxPayload
+	MaxEvents    int           // Most events in a batch. 0 means no limit
+	PollInterval time.Duration // Longest wait for an event. Default FeedDefaultPollInterval
+	Workers      int           // Most batches being sent at once. Default 1
+	Dedup        *Dedup        // If set, duplicate events are dropped
+	Consumer     string        // If set, events are read from RedisStream as this consumer in FeederGroup
+	ClaimAfter   time.Duration // Events pending this long for another consumer are claimed. Default FeedDefaultClaimAfter
+	src          eventSource
+}
+
+// source returns where f takes events from
+func (f *Feeder) source() eventSource {
+	if f.Consumer == "" {
+		return &listSource{client: f.Client, retries: true} // an earlier run may have left events to retry
+	}
+	claimAfter := f.ClaimAfter
+	if claimAfter <= 0 {
+		claimAfter = FeedDefaultClaimAfter
+	}
+	return &streamSource{client: f.Client, consumer: f.Consumer, claimAfter: claimAfter}
+}
+
+// reportQueue records the number of events waiting, and the events pending for each consumer
+func reportQueue(src eventSource) {
+	if n, err := src.depth(); err == nil {
+		FeedQueueDepth.Set(float64(n))
+	}
+	cs, err := src.consumers()
+	if err != nil || cs == nil {
+		return
+	}
+	FeedConsumerPending.Reset() // forget consumers that have been removed
+	FeedConsumerIdle.Reset()
+	for _, c := range cs {
+		FeedConsumerPending.WithLabelValues(c.Name).Set(float64(c.Pending))
+		FeedConsumerIdle.WithLabelValues(c.Name).Set(c.Idle.Seconds())
+	}
+}
+
+// takenBatch is a batch of events, with the queue entries they were taken from, and their IDs
+type takenBatch struct {
+	*EventBatch
+	ids, entries []string
+}
+
+// sendBatch sends a batch of events to the sink, recording batch metrics and the queue depth. Once sent, its queue
+// entries are acknowledged; if it can't be sent, they are put back.
+func (f *Feeder) sendBatch(b *takenBatch) error {
+	FeedBatchesInFlight.Inc()
+	defer FeedBatchesInFlight.Dec()
+	start := time.Now()
+	err := sendTo(context.Background(), f.Sink, b.EventBatch)
+	FeedBatchSeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		FeedBatchFailures.Inc()
+		f.retry(b.ids, b.entries)
+		return err
+	}
+	FeedBatchEvents.Observe(float64(len(b.Events)))
+	lastIngest.Store(time.Now().Unix())
+	if err = f.src.done(b.ids...); err != nil {
+		// The events will be claimed, and sent again
+		slog.Warn("Could not acknowledge events", "events", len(b.ids), "error", err)
+	}
+	reportQueue(f.src)
+	return nil
+}
+
+// retry puts back events taken from the queue that could not be sent
+func (f *Feeder) retry(ids, entries []string) {
+	if err := f.src.retry(ids, entries); err != nil {
+		slog.Error("Could not put back events, they are lost", "events", len(entries), "error", err)
+	}
+}
+
+// uploads is a pool of workers sending batches to the sink, while the next batch is built
+type uploads struct {
+	batches chan *takenBatch
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	err     error // the first batch that failed
+}
+
+// startUploads starts f.Workers workers
+func (f *Feeder) startUploads() *uploads {
+	workers := f.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	u := &uploads{batches: make(chan *takenBatch)}
+	u.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer u.wg.Done()
+			for b := range u.batches {
+				if err := f.sendBatch(b); err != nil {
+					u.mu.Lock()
+					if u.err == nil {
+						u.err = err
+					}
+					u.mu.Unlock()
+				}
+			}
+		}()
+	}
+	return u
+}
+
+// send waits for a free worker, and gives it b. Once a batch has failed, no more are taken, and the error is returned.
+func (u *uploads) send(b *takenBatch) error {
+	if err := u.failed(); err != nil {
+		return err
+	}
+	u.batches <- b
+	return nil
+}
+
+func (u *uploads) failed() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.err
+}
+
+// wait stops the workers once they have sent the batches they hold, and returns the first error
+func (u *uploads) wait() error {
+	close(u.batches)
+	u.wg.Wait()
+	return u.failed()
+}
+
 // FeedEvents sends data arriving via Redis queue to SparkPost ingest API.
 // Send a batch periodically, or every X MB, whichever comes first.
-func FeedEvents(client *redis.Client, host string, apiKey string, maxAge time.Duration) error {
+// When ctx is cancelled, any events already buffered are sent before returning.
+func FeedEvents(ctx context.Context, client *redis.Client, host string, apiKey string, maxAge time.Duration) error {
+	f := Feeder{Client: client, Sink: NewIngestSink(host, apiKey), MaxAge: maxAge}
+	return f.FeedEvents(ctx)
+}
+
+// FeedEvents sends data arriving via Redis queue to the sink, dropping duplicates if f.Dedup is set.
+// A batch is sent when it is full, or the queue is empty and the batch is older than f.MaxAge.
+// Batches are sent by up to f.Workers at once. Before returning, FeedEvents waits for every batch it has taken from
+// the queue to be sent. Events taken but not sent, because of an error, are put back to be taken again.
+func (f *Feeder) FeedEvents(ctx context.Context) (err error) {
+	maxBytes := f.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = SparkPostIngestMaxPayload
+	}
+	if f.src == nil {
+		f.src = f.source()
+	}
+	if s, ok := f.src.(*streamSource); ok {
+		if err = s.createGroup(); err != nil {
+			return err
+		}
+	}
+	u := f.startUploads()
+	defer func() {
+		if uErr := u.wait(); err == nil {
+			err = uErr
+		}
+	}()
 	var tBuf TimedBuffer
-	tBuf.Content = make([]byte, 0, SparkPostIngestMaxPayload) // Pre-allocate for efficiency
-	tBuf.MaxAge = maxAge
+	tBuf.Content = make([]byte, 0, maxBytes) // Pre-allocate for efficiency
+	tBuf.MaxAge = f.MaxAge
+	var takenID, taken string // the entry being added to the batch, if any
+	defer func() {
+		if err == nil {
+			return
+		}
+		ids, entries := tBuf.ids, tBuf.entries
+		if taken != "" {
+			ids, entries = append(ids, takenID), append(entries, taken)
+		}
+		f.retry(ids, entries)
+	}()
 	for {
-		d, err := client.LPop(RedisQueue).Result()
+		if ctx.Err() != nil {
+			// Shutting down - flush what we have
+			if len(tBuf.Content) > 0 {
+				return f.flush(u, &tBuf)
+			}
+			return nil
+		}
+		id, d, err := f.pop(&tBuf)
 		if err == redis.Nil {
 			// Queue is now empty - send this batch if it's old enough, and return
+			reportQueue(f.src)
 			if tBuf.AgedContent() {
-				return SparkPostIngest(tBuf.Content, client, host, apiKey)
+				return f.flush(u, &tBuf)
 			}
-			time.Sleep(1 * time.Second) // polling wait time
 			continue
 		}
 		if err != nil {
 			return err
 		}
-		thisEvent, err := SparkPostEventNDJSON(d, client)
+		takenID, taken = id, d
+		e, err := makeSparkPostEvent(d, f.Client)
+		if err != nil {
+			if !invalidJSON(err) {
+				return err // e.g. Redis unavailable, so the event is taken again
+			}
+			// Drop the event, rather than taking it again, and carry on with the batch
+			slog.Warn("Invalid event dropped", "entry", id, "event", d, "error", err)
+			if err = f.src.done(id); err != nil {
+				return err
+			}
+			taken = ""
+			continue
+		}
+		e.EventWrapper.EventGrouping.EventID = entryEventID(id)
+		if f.Dedup != nil {
+			dup, err := f.Dedup.Duplicate(f.Client, &e, id)
+			if err != nil {
+				return err
+			}
+			if dup {
+				g := &e.EventWrapper.EventGrouping
+				slog.Debug("Duplicate event dropped", "type", g.Type, "message_id", g.MessageID, "url", g.TargetLinkURL)
+				if err = f.src.done(id); err != nil {
+					return err
+				}
+				taken = ""
+				continue
+			}
+		}
+		// Count the event only once it is known not to be a duplicate
+		if err = recordEngagement(f.Client, &e, id); err != nil {
+			return err
+		}
+		thisEvent, err := eventNDJSON(&e)
 		if err != nil {
 			return err
 		}
 		// If this event would make the content oversize, send what we already have
-		if len(tBuf.Content)+len(thisEvent) >= SparkPostIngestMaxPayload {
-			err = SparkPostIngest(tBuf.Content, client, host, apiKey)
-			if err != nil {
+		if len(tBuf.Content) > 0 && len(tBuf.Content)+len(thisEvent) >= maxBytes {
+			if err = f.flush(u, &tBuf); err != nil {
 				return err
 			}
-			tBuf.Content = tBuf.Content[:0] // empty the data, but keep capacity allocated
 		}
 		if len(tBuf.Content) == 0 {
 			// mark time of this event being placed into an empty buffer
 			tBuf.TimeStarted = time.Now()
 		}
 		tBuf.Content = append(tBuf.Content, thisEvent...)
+		tBuf.Events = append(tBuf.Events, e)
+		tBuf.ids = append(tBuf.ids, id)
+		tBuf.entries = append(tBuf.entries, d)
+		taken = ""
+		if f.MaxEvents > 0 && len(tBuf.Events) >= f.MaxEvents {
+			if err = f.flush(u, &tBuf); err != nil {
+				return err
+			}
+		}
 	}
 }
 
-// FeedForever processes events forever
-func FeedForever(client *redis.Client, host string, apiKey string, maxAge time.Duration) {
-	for {
-		if err := FeedEvents(client, host, apiKey, maxAge); err != nil {
-			log.Println(err)
+// pop returns the next event from the queue and its ID, waiting up to the poll interval, or until the batch in tBuf
+// is due. Returns redis.Nil if there is none.
+func (f *Feeder) pop(tBuf *TimedBuffer) (string, string, error) {
+	wait := f.PollInterval
+	if wait <= 0 {
+		wait = FeedDefaultPollInterval
+	}
+	if len(tBuf.Content) > 0 {
+		if due := tBuf.MaxAge - time.Since(tBuf.TimeStarted); due < wait {
+			wait = due
+		}
+	}
+	return f.src.next(wait)
+}
+
+// flush hands the buffered events to the upload workers, then starts a new buffer
+func (f *Feeder) flush(u *uploads, tBuf *TimedBuffer) error {
+	b := &takenBatch{EventBatch: &EventBatch{Events: tBuf.Events, NDJSON: tBuf.Content}, ids: tBuf.ids, entries: tBuf.entries}
+	if err := u.send(b); err != nil {
+		return err
+	}
+	// The workers now own the old buffer; expect the next batch to be about the same size
+	tBuf.Content = make([]byte, 0, len(tBuf.Content))
+	tBuf.Events = make([]SparkPostEvent, 0, len(tBuf.Events))
+	tBuf.ids, tBuf.entries = nil, nil
+	return nil
+}
+
+// FeedForever processes events until ctx is cancelled
+func FeedForever(ctx context.Context, client *redis.Client, host string, apiKey string, maxAge time.Duration) {
+	f := Feeder{Client: client, Sink: NewIngestSink(host, apiKey), MaxAge: maxAge}
+	f.FeedForever(ctx)
+}
+
+// Wait after a feeder error before taking events again, doubling for each error in a row
+const (
+	FeedRetryBackoff    = time.Second
+	FeedRetryMaxBackoff = time.Minute
+)
+
+// FeedForever processes events until ctx is cancelled
+func (f *Feeder) FeedForever(ctx context.Context) {
+	wait := FeedRetryBackoff
+	for ctx.Err() == nil {
+		err := f.FeedEvents(ctx)
+		if err == nil {
+			wait = FeedRetryBackoff
+			continue
+		}
+		slog.Error("Feeder error", "error", err, "wait", wait)
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+		wait *= 2
+		if wait > FeedRetryMaxBackoff {
+			wait = FeedRetryMaxBackoff
 		}
 	}
 }
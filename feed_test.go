@@ -4,17 +4,23 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	spmta "github.com/tuck1s/sparkypmtatracking"
 )
 
@@ -30,8 +36,7 @@ const testMockBatchResponse = "mock test passed"
 // Capture the usual log output into a memory buffer, for later verification
 func captureLog() *bytes.Buffer {
 	var buf bytes.Buffer
-	log.SetOutput(&buf)
-	log.SetFlags(0) // disable date/time prefix as it makes hard to compare
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil))) // also captures the standard log package
 	return &buf
 }
 
@@ -157,7 +162,17 @@ func TestFeedForever(t *testing.T) {
 	go startMockIngest(t, mockIngestAddrPort)
 	client := spmta.MyRedis()
 	// Start the feeder process concurrently. We don't have to wait the usual time
-	go spmta.FeedForever(client, "http://"+mockIngestAddrPort, mockAPIKey, testTime)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		spmta.FeedForever(ctx, client, "http://"+mockIngestAddrPort, mockAPIKey, testTime)
+		close(done)
+	}()
+	// Stop the feeder before the next test, so it doesn't take that test's events
+	defer func() {
+		cancel()
+		<-done
+	}()
 
 	t.Log("One event")
 	myLogp := captureLog()
@@ -178,6 +193,52 @@ func TestFeedForever(t *testing.T) {
 	checkLog(t, 10, myLogp, testMockBatchResponse, 1)
 }
 
+// On shutdown, FeedEvents should send events already taken from the queue, even though the batch is not yet aged
+func TestFeedEventsShutdownFlush(t *testing.T) {
+	mockIngest := httptest.NewServer(http.HandlerFunc(ingestServer))
+	defer mockIngest.Close()
+	client := spmta.MyRedis()
+	emptyRedisQueue(client)
+	myLogp := captureLog()
+	mockEvents(t, 3, client, true)
+	eventsBefore := histogramSum(t, spmta.FeedBatchEvents)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- spmta.FeedEvents(ctx, client, mockIngest.URL, mockAPIKey, time.Hour)
+	}()
+	// wait for the events to be taken from the queue, then shut down
+	for i := 0; i < 50; i++ {
+		if n, _ := client.LLen(spmta.RedisQueue).Result(); n == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("FeedEvents did not return after shutdown")
+	}
+	checkLog(t, 1, myLogp, testMockBatchResponse, 1)
+	if got := histogramSum(t, spmta.FeedBatchEvents) - eventsBefore; got != 3 {
+		t.Errorf("Expected 3 events recorded in batch metrics, got %v", got)
+	}
+}
+
+// histogramSum returns the sum of the values observed by h
+func histogramSum(t *testing.T, h prometheus.Histogram) float64 {
+	var m dto.Metric
+	if err := h.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleSum()
+}
+
 func wrongTypeErr(err error) bool {
 	s := err.Error()
 	return len(s) >= 9 && s[0:9] == "WRONGTYPE"
@@ -195,6 +256,7 @@ func emptyRedisQueue(client *redis.Client) {
 			break
 		}
 	}
+	client.Del(spmta.RedisRetryQueue)
 }
 
 const ttl = time.Duration(testTime * 20) // expires fairly quickly after test run
@@ -250,7 +312,7 @@ func testEvent(msgID string) spmta.TrackEvent {
 func TestFeedEventsErrorCases(t *testing.T) {
 	client := spmta.MyRedis()
 	client.Close() // deliberately close the connection before using
-	err := spmta.FeedEvents(client, "http://example.com", "", testTime)
+	err := spmta.FeedEvents(context.Background(), client, "http://example.com", "", testTime)
 	if err.Error() != "redis: client is closed" {
 		t.Errorf("Error %v", err)
 	}
@@ -326,7 +388,7 @@ func TestSparkPostEventNDJSONFaultyInputs(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	checkLog(t, 1, myLogp, "Warning: redis key "+redisKeyNotFoundMsgID+" not found", 1)
+	checkLog(t, 1, myLogp, `msg="Redis key not found" key=`+redisKeyNotFoundMsgID, 1)
 
 	// MessageID Redis record corrupt
 	const augmentFaulty = `{"header_x-sp-subaccount-id"`
@@ -372,8 +434,217 @@ func TestFeedEventsFaultyInputs(t *testing.T) {
 	}
 	host := "http://api.sparkpost.com/not_an_api"
 	apiKey := "junk"
-	err := spmta.FeedEvents(client, host, apiKey, testTime)
-	if !strings.Contains(err.Error(), "end of JSON") {
+	// The invalid event is dropped, and the feeder carries on
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := spmta.FeedEvents(ctx, client, host, apiKey, testTime)
+	if err != nil {
 		t.Error(err)
 	}
+	if n := client.LLen(spmta.RedisQueue).Val() + client.LLen(spmta.RedisRetryQueue).Val(); n != 0 {
+		t.Errorf("Expected the invalid event dropped, got %d on the queues", n)
+	}
+}
+
+// batchSink records the number of events in each batch sent to it
+type batchSink struct {
+	sizes []int
+}
+
+func (s *batchSink) Name() string { return "batches" }
+
+func (s *batchSink) Send(ctx context.Context, b *spmta.EventBatch) error {
+	s.sizes = append(s.sizes, len(b.Events))
+	return nil
+}
+
+func (s *batchSink) Close() error { return nil }
+
+func TestFeederBatchLimits(t *testing.T) {
+	client := spmta.MyRedis()
+	for _, c := range []struct {
+		f    spmta.Feeder
+		want string
+	}{
+		{spmta.Feeder{}, "[5]"},
+		{spmta.Feeder{MaxEvents: 2}, "[2 2 1]"},
+		{spmta.Feeder{MaxBytes: 1}, "[1 1 1 1 1]"},
+	} {
+		emptyRedisQueue(client)
+		mockEvents(t, 5, client, false)
+		var sink batchSink
+		c.f.Client, c.f.Sink = client, &sink
+		if err := c.f.FeedEvents(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(sink.sizes); got != c.want {
+			t.Errorf("%+v: got batches %s, want %s", c.f, got, c.want)
+		}
+	}
+}
+
+// An event arriving while the feeder waits on an empty queue is taken straight away, not at the next poll
+func TestFeederBlockingPop(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisQueue(client)
+	var sink batchSink
+	f := spmta.Feeder{Client: client, Sink: &sink, PollInterval: 10 * time.Second}
+	done := make(chan error)
+	go func() {
+		done <- f.FeedEvents(context.Background())
+	}()
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	mockEvents(t, 1, client, false)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("FeedEvents did not take the event")
+	}
+	if took := time.Since(start); took > 2*time.Second || fmt.Sprint(sink.sizes) != "[1]" {
+		t.Errorf("Sent %v after %v", sink.sizes, took)
+	}
+}
+
+// slowIngest is a fake Ingest API taking delay to respond, that counts the events it receives and the most requests
+// it has had at once. It fails every request with status, if set, or else the first fails requests.
+type slowIngest struct {
+	delay             time.Duration
+	status            int
+	fails             int
+	mu                sync.Mutex
+	events, now, most int
+	eventIDs          map[string]bool // every event_id received, including in failed requests
+}
+
+func (s *slowIngest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.now++
+	if s.now > s.most {
+		s.most = s.now
+	}
+	status := s.status
+	if s.fails > 0 {
+		s.fails--
+		status = http.StatusServiceUnavailable
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.now--
+		s.mu.Unlock()
+	}()
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	n := 0
+	for sc := bufio.NewScanner(zr); sc.Scan(); {
+		var e spmta.SparkPostEvent
+		if json.Unmarshal(sc.Bytes(), &e) == nil {
+			s.mu.Lock()
+			if s.eventIDs == nil {
+				s.eventIDs = make(map[string]bool)
+			}
+			s.eventIDs[e.EventWrapper.EventGrouping.EventID] = true
+			s.mu.Unlock()
+		}
+		n++
+	}
+	time.Sleep(s.delay)
+	if status != 0 {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"errors":[{"message":"try again later"}]}`))
+		return
+	}
+	s.mu.Lock()
+	s.events += n
+	s.mu.Unlock()
+	w.Write([]byte(`{"results":{"id":"slow"}}`))
+}
+
+func TestFeederWorkers(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisQueue(client)
+	mockEvents(t, 9, client, false)
+	ingest := &slowIngest{delay: 500 * time.Millisecond}
+	mock := httptest.NewServer(ingest)
+	defer mock.Close()
+	// Four full batches, then FeedEvents returns after sending the last event when the queue is empty
+	f := spmta.Feeder{Client: client, Sink: spmta.NewIngestSink(mock.URL, mockAPIKey), MaxEvents: 2, Workers: 4}
+
+	start := time.Now()
+	if err := f.FeedEvents(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	took := time.Since(start)
+	ingest.mu.Lock()
+	defer ingest.mu.Unlock()
+	// FeedEvents waits for every batch to be sent before returning
+	if ingest.events != 9 {
+		t.Errorf("Expected 9 events received, got %d", ingest.events)
+	}
+	if ingest.most < 2 || ingest.most > 4 {
+		t.Errorf("Expected 2 to 4 batches sent at once, got %d", ingest.most)
+	}
+	if took >= 5*ingest.delay {
+		t.Errorf("Batches sent one at a time, taking %v", took)
+	}
+	if got := testutil.ToFloat64(spmta.FeedBatchesInFlight); got != 0 {
+		t.Errorf("Expected no batches in flight, got %v", got)
+	}
+}
+
+// A failed batch stops the feeder taking more events, once the batches in flight are sent
+func TestFeederWorkersFailure(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisQueue(client)
+	mockEvents(t, 20, client, false)
+	ingest := &slowIngest{delay: 100 * time.Millisecond, status: http.StatusServiceUnavailable}
+	mock := httptest.NewServer(ingest)
+	defer mock.Close()
+	f := spmta.Feeder{Client: client, Sink: spmta.NewIngestSink(mock.URL, mockAPIKey), MaxEvents: 1, Workers: 2}
+	if err := f.FeedEvents(context.Background()); err == nil || !strings.Contains(err.Error(), "try again later") {
+		t.Errorf("Expected an error, got %v", err)
+	}
+	if n := client.LLen(spmta.RedisQueue).Val(); n == 0 {
+		t.Error("Expected events to be left on the queue")
+	}
+	emptyRedisQueue(client)
+}
+
+// Events in a failed batch, and those taken for the next, are put back, and sent by the next run
+func TestFeederRetry(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisQueue(client)
+	mockEvents(t, 9, client, false)
+	ingest := &slowIngest{delay: 100 * time.Millisecond, fails: 1}
+	mock := httptest.NewServer(ingest)
+	defer mock.Close()
+	f := spmta.Feeder{Client: client, Sink: spmta.NewIngestSink(mock.URL, mockAPIKey), MaxEvents: 2, Workers: 2}
+	if err := f.FeedEvents(context.Background()); err == nil || !strings.Contains(err.Error(), "try again later") {
+		t.Errorf("Expected an error, got %v", err)
+	}
+	if n := client.LLen(spmta.RedisRetryQueue).Val(); n == 0 {
+		t.Error("Expected events to be put back")
+	}
+	if err := f.FeedEvents(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ingest.mu.Lock()
+	defer ingest.mu.Unlock()
+	if ingest.events != 9 {
+		t.Errorf("Expected 9 events received, got %d", ingest.events)
+	}
+	// Events sent again keep their event_id
+	if len(ingest.eventIDs) != 9 {
+		t.Errorf("Expected 9 event IDs, got %d", len(ingest.eventIDs))
+	}
+	if n := client.LLen(spmta.RedisRetryQueue).Val() + client.LLen(spmta.RedisQueue).Val(); n != 0 {
+		t.Errorf("Expected nothing left on the queues, got %d", n)
+	}
 }
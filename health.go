@@ -0,0 +1,126 @@
+package sparkypmtatracking
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Health check paths. These are exact matches, so don't collide with tracking link paths, which are base64 data or
+// start with a link format prefix.
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+)
+
+// ReadyCheck reports whether a service can do useful work, with details to include in the readiness response
+type ReadyCheck func() (details map[string]interface{}, err error)
+
+// HandleHealth adds the liveness and readiness endpoints to mux
+func HandleHealth(mux *http.ServeMux, ready ReadyCheck) {
+	mux.HandleFunc(LivenessPath, func(w http.ResponseWriter, req *http.Request) {
+		writeHealth(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+	})
+	mux.HandleFunc(ReadinessPath, func(w http.ResponseWriter, req *http.Request) {
+		details, err := ready()
+		if details == nil {
+			details = make(map[string]interface{})
+		}
+		if err != nil {
+			details["status"] = "unavailable"
+			details["error"] = err.Error()
+			writeHealth(w, http.StatusServiceUnavailable, details)
+			return
+		}
+		details["status"] = "ok"
+		writeHealth(w, http.StatusOK, details)
+	})
+}
+
+// HealthServer returns a server for the liveness and readiness endpoints, to run on its own listen address
+func HealthServer(addr string, ready ReadyCheck) *http.Server {
+	mux := http.NewServeMux()
+	HandleHealth(mux, ready)
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+// ServeHealth starts a HealthServer on addr in the background, returning it so it can be shut down.
+// If addr is empty, nothing is served and nil is returned.
+func ServeHealth(addr string, ready ReadyCheck) *http.Server {
+	if addr == "" {
+		return nil
+	}
+	srv := HealthServer(addr, ready)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Health server error", "addr", addr, "error", err)
+		}
+	}()
+	slog.Info("Serving health checks", "addr", addr, "paths", []string{LivenessPath, ReadinessPath})
+	return srv
+}
+
+func writeHealth(w http.ResponseWriter, code int, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Warn("http.ResponseWriter error", "error", err)
+	}
+}
+
+// TrackerReady checks that the tracker can queue events, i.e. Redis is reachable
+func TrackerReady() (map[string]interface{}, error) {
+	client := MyRedis()
+	defer client.Close()
+	return nil, client.Ping().Err()
+}
+
+// lastIngest holds the Unix time of the last batch accepted by the ingest API, or 0 if none yet
+var lastIngest atomic.Int64
+
+// FeederReady returns a check that Redis is reachable, reporting the time of the last successful ingest and the
+// number of events waiting in the queue
+func FeederReady(client *redis.Client) ReadyCheck {
+	f := Feeder{Client: client}
+	return f.Ready()
+}
+
+// Ready returns a check that Redis is reachable, reporting the time of the last successful ingest and the number of
+// events waiting in the queue. For a consumer group, it also reports the events pending for each consumer.
+func (f *Feeder) Ready() ReadyCheck {
+	src := f.source()
+	return func() (map[string]interface{}, error) {
+		details := make(map[string]interface{})
+		if t := lastIngest.Load(); t != 0 {
+			details["last_ingest"] = time.Unix(t, 0).UTC().Format(time.RFC3339)
+		} else {
+			details["last_ingest"] = nil
+		}
+		n, err := src.depth()
+		if err != nil {
+			return details, err
+		}
+		details["queue_length"] = n
+		cs, err := src.consumers()
+		if err != nil {
+			return details, err
+		}
+		if cs != nil {
+			consumers := make(map[string]interface{})
+			for _, c := range cs {
+				consumers[c.Name] = map[string]interface{}{"pending": c.Pending, "idle_seconds": int64(c.Idle.Seconds())}
+			}
+			details["consumers"] = consumers
+		}
+		return details, nil
+	}
+}
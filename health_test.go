@@ -0,0 +1,82 @@
+package sparkypmtatracking_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+// getHealth makes a request to handler and returns the status code and decoded JSON body
+func getHealth(t *testing.T, handler http.Handler, path string) (int, map[string]interface{}) {
+	req := httptest.NewRequest("GET", path, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var body map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s: %v %s", path, err, rr.Body.String())
+	}
+	return rr.Code, body
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	var readyErr error
+	srv := spmta.HealthServer("", func() (map[string]interface{}, error) {
+		return map[string]interface{}{"detail": "x"}, readyErr
+	})
+	if code, body := getHealth(t, srv.Handler, spmta.LivenessPath); code != http.StatusOK || body["status"] != "ok" {
+		t.Errorf("Liveness: %d %v", code, body)
+	}
+	if code, body := getHealth(t, srv.Handler, spmta.ReadinessPath); code != http.StatusOK || body["status"] != "ok" || body["detail"] != "x" {
+		t.Errorf("Readiness: %d %v", code, body)
+	}
+	readyErr = errors.New("not connected")
+	if code, body := getHealth(t, srv.Handler, spmta.ReadinessPath); code != http.StatusServiceUnavailable || body["error"] != "not connected" {
+		t.Errorf("Readiness: %d %v", code, body)
+	}
+	// Still alive, even when not ready
+	if code, _ := getHealth(t, srv.Handler, spmta.LivenessPath); code != http.StatusOK {
+		t.Errorf("Liveness: %d", code)
+	}
+	if spmta.ServeHealth("", nil) != nil {
+		t.Errorf("Expected no health server without an address")
+	}
+}
+
+// Health checks are served alongside tracking links, without reaching the tracker
+func TestTrackerHealth(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/", spmta.NewTracker(&spmta.TrackerConfig{}))
+	spmta.HandleHealth(mux, spmta.TrackerReady)
+	if code, body := getHealth(t, mux, spmta.ReadinessPath); code != http.StatusOK {
+		t.Errorf("Readiness: %d %v", code, body)
+	}
+	// Tracking requests still go to the tracker, which rejects the unknown host
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/healthz/x", nil))
+	if rr.Code != http.StatusMisdirectedRequest {
+		t.Errorf("Expected tracker response, got %d", rr.Code)
+	}
+}
+
+func TestFeederReady(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisQueue(client)
+	mockEvents(t, 2, client, true)
+	details, err := spmta.FeederReady(client)()
+	if err != nil || details["queue_length"] != int64(2) {
+		t.Errorf("Unexpected %v %v", details, err)
+	}
+	if _, found := details["last_ingest"]; !found {
+		t.Errorf("Expected last_ingest in %v", details)
+	}
+	emptyRedisQueue(client)
+
+	client.Close()
+	if _, err = spmta.FeederReady(client)(); err == nil {
+		t.Errorf("Expected error from closed Redis client")
+	}
+}
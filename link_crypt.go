@@ -0,0 +1,107 @@
+package sparkypmtatracking
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// LinkKeys holds the keys for encrypting link data, so the recipient, message ID and target URL can't be read from links.
+// Links are encrypted with the Current key. Links made with any of the Keys can be decrypted, so keys can be rotated
+// without breaking links already sent: add the new key, make it current, and remove the old key once its links have expired.
+type LinkKeys struct {
+	Current string            `json:"current"` // id of the key used to encrypt
+	Keys    map[string]string `json:"keys"`    // key id to base64-encoded AES key of 16, 24 or 32 bytes
+	aeads   map[string]cipher.AEAD
+}
+
+// LoadLinkKeys reads a JSON link keys file
+func LoadLinkKeys(filename string) (*LinkKeys, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadLinkKeys(f)
+}
+
+// ReadLinkKeys reads JSON link keys from r, and checks them
+func ReadLinkKeys(r io.Reader) (*LinkKeys, error) {
+	var k LinkKeys
+	if err := json.NewDecoder(r).Decode(&k); err != nil {
+		return nil, err
+	}
+	if _, ok := k.Keys[k.Current]; !ok {
+		return nil, fmt.Errorf("Link keys have no key for current id %q", k.Current)
+	}
+	k.aeads = make(map[string]cipher.AEAD, len(k.Keys))
+	for id, key := range k.Keys {
+		if len(id) == 0 || len(id) > 255 {
+			return nil, fmt.Errorf("Link key id %q must be 1 to 255 bytes", id)
+		}
+		keyBytes, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("Link key %s: %v", id, err)
+		}
+		block, err := aes.NewCipher(keyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Link key %s: %v", id, err)
+		}
+		if k.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("Link key %s: %v", id, err)
+		}
+	}
+	return &k, nil
+}
+
+// EncryptPath returns the zlib-compressed, AES-GCM encrypted, base64 encoded version of data as a URL path string.
+// The id of the key used is carried with the data, and authenticated along with it.
+func (k *LinkKeys) EncryptPath(data []byte) (string, error) {
+	zData, err := zlibCompress(data)
+	if err != nil {
+		return "", err
+	}
+	aead := k.aeads[k.Current]
+	// Layout is: key id length, key id, nonce, ciphertext
+	buf := make([]byte, 0, 1+len(k.Current)+aead.NonceSize()+len(zData)+aead.Overhead())
+	buf = append(buf, byte(len(k.Current)))
+	buf = append(buf, k.Current...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	buf = append(buf, nonce...)
+	buf = aead.Seal(buf, nonce, zData, []byte(k.Current))
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
+
+// DecryptPath returns the data from a URL path string made by EncryptPath, checking it has not been altered
+func (k *LinkKeys) DecryptPath(s string) ([]byte, error) {
+	buf, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < 1 || len(buf) < 1+int(buf[0]) {
+		return nil, errors.New("Encrypted link is too short")
+	}
+	id := string(buf[1 : 1+buf[0]])
+	buf = buf[1+len(id):]
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown link key id %q", id)
+	}
+	if len(buf) < aead.NonceSize() {
+		return nil, errors.New("Encrypted link is too short")
+	}
+	zData, err := aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, errors.New("Encrypted link could not be decrypted")
+	}
+	return zlibDecompress(zData)
+}
@@ -0,0 +1,110 @@
+package sparkypmtatracking_test
+
+import (
+	"strings"
+	"testing"
+
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+const testLinkKeys = `{"current": "2024b", "keys": {"2024a": "esg80o6C8z8Vt5jHW/FtBCEKbRGjQh45nagjh6gtIrw=", "2024b": "12Dd6lVTOITyY4+ocI4stnRrtt9KB5732H8ldkpdL1Q="}}`
+
+func TestLinkKeys(t *testing.T) {
+	keys, err := spmta.ReadLinkKeys(strings.NewReader(testLinkKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(`{"act":"c","t_url":"https://example.com","msg_id":"0000123456789abcdef0","rcpt":"bob@example.com"}`)
+	enc, err := keys.EncryptPath(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(enc), "example") {
+		t.Errorf("Encrypted path should not contain plain text")
+	}
+	if enc2, _ := keys.EncryptPath(data); enc2 == enc {
+		t.Errorf("Encrypting twice should give different results")
+	}
+	dec, err := keys.DecryptPath(enc)
+	if err != nil || string(dec) != string(data) {
+		t.Errorf("DecryptPath returned %s %v", dec, err)
+	}
+	// Full links can't be decrypted
+	full, err := spmta.EncodePath(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = keys.DecryptPath(full); err == nil {
+		t.Errorf("Expected error decrypting plain link")
+	}
+	// Altered links can't be decrypted
+	b := []byte(enc)
+	b[len(b)/2] ^= 1
+	if _, err = keys.DecryptPath(string(b)); err == nil {
+		t.Errorf("Expected error decrypting altered link")
+	}
+
+	// After rotating to a new key, links made with the old key still decrypt, but not once it's removed
+	rotated, err := spmta.ReadLinkKeys(strings.NewReader(`{"current": "2025a", "keys": {"2024b": "12Dd6lVTOITyY4+ocI4stnRrtt9KB5732H8ldkpdL1Q=", "2025a": "irss8SXr1VjLOkU+vADK0+72GerUsuw9uCeINdybA8w="}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, err = rotated.DecryptPath(enc); err != nil || string(dec) != string(data) {
+		t.Errorf("DecryptPath with rotated keys returned %s %v", dec, err)
+	}
+	removed, err := spmta.ReadLinkKeys(strings.NewReader(`{"current": "2024a", "keys": {"2024a": "esg80o6C8z8Vt5jHW/FtBCEKbRGjQh45nagjh6gtIrw="}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = removed.DecryptPath(enc); err == nil || !strings.Contains(err.Error(), "Unknown link key id") {
+		t.Errorf("Expected unknown key id, got %v", err)
+	}
+
+	eList := [][]string{
+		{"unexpected EOF", `{"current": "a", "keys": {`},
+		{"no key for current", `{"current": "b", "keys": {"a": "esg80o6C8z8Vt5jHW/FtBCEKbRGjQh45nagjh6gtIrw="}}`},
+		{"illegal base64", `{"current": "a", "keys": {"a": "not base64!"}}`},
+		{"invalid key size", `{"current": "a", "keys": {"a": "AAAA"}}`},
+	}
+	for _, e := range eList {
+		if _, err := spmta.ReadLinkKeys(strings.NewReader(e[1])); err == nil || !strings.Contains(err.Error(), e[0]) {
+			t.Errorf("Expected error containing %q, got %v", e[0], err)
+		}
+	}
+}
+
+func TestEncryptedLinks(t *testing.T) {
+	keys, err := spmta.ReadLinkKeys(strings.NewReader(testLinkKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trackingURL := RandomBaseURL()
+	w, err := spmta.NewWrapper(trackingURL, true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetLinkKeys(keys)
+	msgID := spmta.UniqMessageID()
+	recip := RandomRecipient()
+	w.SetMessageInfo(msgID, recip)
+	target := RandomURLWithPath()
+	for _, signingKey := range []string{"", "signing key"} {
+		w.SetSigningKey(signingKey)
+		link := w.WrapURL(target)
+		if !strings.HasPrefix(link, trackingURL+"/e/") {
+			t.Errorf("Unexpected encrypted link %s", link)
+		}
+		_, wd, _, err := spmta.ResolveLink(link, nil, keys)
+		if err != nil || wd.TargetLinkURL != target || wd.MessageID != msgID || wd.RcptTo != recip {
+			t.Errorf("ResolveLink returned %v %v", wd, err)
+		}
+		if _, _, _, err = spmta.ResolveLink(link, nil, nil); err == nil {
+			t.Errorf("Expected error with no link keys")
+		}
+		if signingKey != "" {
+			if err = spmta.VerifyLink(link, []byte(signingKey)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package sparkypmtatracking
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Link paths start with a prefix giving their format, so that links already sent keep working when new formats are added.
+// v0 links, made before formats were versioned, have no prefix.
+const (
+	FullLinkPrefix      = "v1" // zlib compressed, base64 encoded JSON, as per v0
+	ShortLinkPrefix     = "s"  // id of link data held in a LinkStore
+	EncryptedLinkPrefix = "e"  // zlib compressed, AES-GCM encrypted, base64 encoded JSON
+)
+
+// ErrLinkStore is returned when a link can't be decoded because the link store is unavailable, rather than the link being faulty
+var ErrLinkStore = errors.New("Link store error")
+
+// linkFormat describes how to decode one format of link path
+type linkFormat struct {
+	decode      func(p string, links LinkStore, keys *LinkKeys) ([]byte, error) // returns the JSON form of the link data
+	errorReason string                                                          // LinkErrors label when the link can't be decoded
+	truncatable bool                                                            // link data can be partly recovered if the end is lost
+}
+
+// linkFormats is the registry of link path formats, by prefix. Formats must not be removed while links using them may be clicked.
+var linkFormats = map[string]linkFormat{
+	"":                  {decode: decodeFullPath, errorReason: "decode", truncatable: true},
+	FullLinkPrefix:      {decode: decodeFullPath, errorReason: "decode", truncatable: true},
+	ShortLinkPrefix:     {decode: decodeShortPath, errorReason: "not_found"},
+	EncryptedLinkPrefix: {decode: decodeEncryptedPath, errorReason: "decrypt"},
+}
+
+func decodeFullPath(p string, _ LinkStore, _ *LinkKeys) ([]byte, error) {
+	if strings.Contains(p, "/") {
+		return nil, errors.New("Invalid link path")
+	}
+	return DecodePath(p)
+}
+
+func decodeShortPath(id string, links LinkStore, _ *LinkKeys) ([]byte, error) {
+	if links == nil {
+		return nil, errors.New("Short link needs a link store")
+	}
+	wd, err := links.LoadLink(id)
+	if err == ErrLinkNotFound {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrLinkStore, err)
+	}
+	return json.Marshal(wd)
+}
+
+func decodeEncryptedPath(p string, _ LinkStore, keys *LinkKeys) ([]byte, error) {
+	if keys == nil {
+		return nil, errors.New("Encrypted link needs link keys")
+	}
+	return keys.DecryptPath(p)
+}
+
+// splitLinkPrefix returns the format prefix of a link path (blank for v0 links), and the rest of the path
+func splitLinkPrefix(p string) (string, string) {
+	p = strings.TrimPrefix(p, "/")
+	if i := strings.Index(p, "/"); i > 0 {
+		if _, ok := linkFormats[p[:i]]; ok {
+			return p[:i], p[i+1:]
+		}
+	}
+	return "", p
+}
+
+// ResolveLink decodes a link URL of any format, looking up short links in links, and decrypting encrypted links with keys.
+// Returns JSON intermediate form, decoded Wrapper data, and tracking domain, as per DecodeLink.
+func ResolveLink(urlStr string, links LinkStore, keys *LinkKeys) ([]byte, WrapperData, string, error) {
+	var wd WrapperData
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, wd, "", err
+	}
+	decodeTrackingDomain := u.Scheme + "://" + u.Host
+	if !strings.HasPrefix(u.Path, "/") {
+		return nil, wd, decodeTrackingDomain, errors.New("Invalid link path")
+	}
+	prefix, p := splitLinkPrefix(u.Path)
+	p, _ = splitSignature(p) // signature is not checked here
+	eBytes, err := linkFormats[prefix].decode(p, links, keys)
+	if err != nil {
+		return eBytes, wd, decodeTrackingDomain, err
+	}
+	err = json.Unmarshal(eBytes, &wd)
+	return eBytes, wd, decodeTrackingDomain, err
+}
@@ -0,0 +1,98 @@
+package sparkypmtatracking_test
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+// goldenLink is a link made by an earlier version of the wrapper, that must still decode
+type goldenLink struct {
+	Name       string            `json:"name"`
+	Link       string            `json:"link"`
+	SigningKey string            `json:"signing_key"`
+	Data       spmta.WrapperData `json:"data"`
+}
+
+// readGoldenLinks returns the golden links, the keys for the encrypted ones, and a link store holding the short ones
+func readGoldenLinks(t *testing.T) ([]goldenLink, *spmta.LinkKeys, spmta.LinkStore) {
+	f, err := os.Open("testdata/golden_links.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var golden []goldenLink
+	if err = json.NewDecoder(f).Decode(&golden); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := spmta.LoadLinkKeys("testdata/link_keys.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Short link ids must be stable, so the wrapper should make the same link again
+	store := spmta.NewMemoryLinkStore()
+	for _, g := range golden {
+		if g.Name != "short" {
+			continue
+		}
+		w, err := spmta.NewWrapper("https://track.example.com", true, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.SetLinkStore(store)
+		w.SetMessageInfo(g.Data.MessageID, g.Data.RcptTo)
+		if link := w.WrapURL(g.Data.TargetLinkURL); link != g.Link {
+			t.Errorf("Short link id changed: got %s, golden %s", link, g.Link)
+		}
+	}
+	return golden, keys, store
+}
+
+func TestGoldenLinks(t *testing.T) {
+	golden, keys, store := readGoldenLinks(t)
+	names := make(map[string]bool)
+	for _, g := range golden {
+		names[g.Name] = true
+		_, wd, domain, err := spmta.ResolveLink(g.Link, store, keys)
+		if err != nil || wd != g.Data || domain != "https://track.example.com" {
+			t.Errorf("%s: decoded %v %s %v, expected %v", g.Name, wd, domain, err, g.Data)
+		}
+		if g.SigningKey != "" {
+			if err = spmta.VerifyLink(g.Link, []byte(g.SigningKey)); err != nil {
+				t.Errorf("%s: %v", g.Name, err)
+			}
+		}
+	}
+	// Every format must have a golden link
+	for _, n := range []string{"v0", "v1", "short", "encrypted"} {
+		if !names[n] {
+			t.Errorf("No golden link for %s", n)
+		}
+	}
+}
+
+func TestLinkFormats(t *testing.T) {
+	w, err := spmta.NewWrapper("https://track.example.com/base", true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetMessageInfo(spmta.UniqMessageID(), RandomRecipient())
+	target := RandomURLWithPath()
+	link := w.WrapURL(target)
+	if !strings.HasPrefix(link, "https://track.example.com/base/"+spmta.FullLinkPrefix+"/") {
+		t.Errorf("Link %s does not carry the format prefix", link)
+	}
+	// Links with unknown prefixes are treated as v0, and don't decode
+	if _, _, _, err = spmta.DecodeLink("https://track.example.com/v9/" + link[strings.LastIndex(link, "/")+1:]); err == nil {
+		t.Errorf("Expected error from unknown format")
+	}
+	// Short and encrypted links need their store and keys
+	for _, l := range []string{"https://track.example.com/s/AAAAAAAAAAAAAAAA", "https://track.example.com/e/AAAA"} {
+		if _, _, _, err = spmta.DecodeLink(l); err == nil {
+			t.Errorf("Expected error decoding %s", l)
+		}
+	}
+}
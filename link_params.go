@@ -0,0 +1,119 @@
+package sparkypmtatracking
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// LinkParamData is available to link parameter templates, e.g. utm_content={{.MessageID}}
+type LinkParamData struct {
+	MessageID string
+	Campaign  string // from the campaign_id in the X-MSYS-API header, if present
+}
+
+// linkParam is a query parameter added to target links, with its value made from a template
+type linkParam struct {
+	name  string
+	value *template.Template
+}
+
+// parseLinkParams reads parameters in URL query form, e.g. utm_source=email&utm_campaign={{.Campaign}}
+func parseLinkParams(s string) ([]linkParam, error) {
+	q, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	var params []linkParam
+	for name, values := range q {
+		t, err := template.New(name).Parse(values[0])
+		if err == nil {
+			err = t.Execute(io.Discard, LinkParamData{}) // catch unknown fields now, rather than per link
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Link parameter %s: %v", name, err)
+		}
+		params = append(params, linkParam{name: name, value: t})
+	}
+	sort.Slice(params, func(i, j int) bool { return params[i].name < params[j].name })
+	return params, nil
+}
+
+// SetLinkParams sets query parameters to add to target links when wrapping them, given in URL query form,
+// e.g. utm_source=email&utm_campaign={{.Campaign}}. Values are templates, filled from LinkParamData.
+// Blank string means no parameters are added.
+func (wrap *Wrapper) SetLinkParams(s string) error {
+	if wrap == nil {
+		return nil
+	}
+	params, err := parseLinkParams(s)
+	if err != nil {
+		return err
+	}
+	wrap.linkParams = params
+	return nil
+}
+
+// SetCampaign sets the per-message campaign, for use in link parameters
+func (wrap *Wrapper) SetCampaign(c string) {
+	if wrap != nil {
+		wrap.campaign = c
+	}
+}
+
+// addLinkParams returns target with the wrapper's link parameters added. Parameters already in target are left alone,
+// and parameters with blank values are not added. Only http and https targets get parameters.
+func (wrap *Wrapper) addLinkParams(target string) string {
+	if len(wrap.linkParams) == 0 {
+		return target
+	}
+	data := LinkParamData{MessageID: wrap.messageID, Campaign: wrap.campaign}
+	extra := url.Values{}
+	for _, p := range wrap.linkParams {
+		var v bytes.Buffer
+		if err := p.value.Execute(&v, data); err != nil {
+			slog.Warn("Link parameter error", "param", p.name, "error", err)
+			continue
+		}
+		if v.Len() > 0 {
+			extra.Set(p.name, v.String())
+		}
+	}
+	return MergeQuery(target, extra)
+}
+
+// MergeQuery returns target URL with the parameters in extra added, unless target already has them.
+// The rest of target is left as it was. Only http and https targets get parameters.
+func MergeQuery(target string, extra url.Values) string {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return target
+	}
+	q := u.Query()
+	add := url.Values{}
+	for k, v := range extra {
+		if _, present := q[k]; !present {
+			add[k] = v
+		}
+	}
+	if len(add) == 0 {
+		return target
+	}
+	// Insert before any fragment, keeping the existing query as it was
+	frag := ""
+	if i := strings.Index(target, "#"); i >= 0 {
+		target, frag = target[:i], target[i:]
+	}
+	switch {
+	case !strings.Contains(target, "?"):
+		target += "?"
+	case !strings.HasSuffix(target, "?") && !strings.HasSuffix(target, "&"):
+		target += "&"
+	}
+	return target + add.Encode() + frag
+}
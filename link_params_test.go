@@ -0,0 +1,64 @@
+package sparkypmtatracking_test
+
+import (
+	"net/url"
+	"testing"
+
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+func TestMergeQuery(t *testing.T) {
+	extra := url.Values{"utm_source": {"email"}, "pet": {"cat"}}
+	cases := map[string]string{
+		"https://example.com":                     "https://example.com?pet=cat&utm_source=email",
+		"https://example.com/a?x=1":               "https://example.com/a?x=1&pet=cat&utm_source=email",
+		"https://example.com/a?x=1&":              "https://example.com/a?x=1&pet=cat&utm_source=email",
+		"https://example.com/a?pet=dog#frag":      "https://example.com/a?pet=dog&utm_source=email#frag",
+		"http://example.com/a?z=%7E&y=2":          "http://example.com/a?z=%7E&y=2&pet=cat&utm_source=email",
+		"mailto:bob@example.com":                  "mailto:bob@example.com",
+		"https://example.com/?pet=a&utm_source=b": "https://example.com/?pet=a&utm_source=b",
+	}
+	for target, expected := range cases {
+		if got := spmta.MergeQuery(target, extra); got != expected {
+			t.Errorf("MergeQuery(%s) = %s, expected %s", target, got, expected)
+		}
+	}
+	if got := spmta.MergeQuery("https://example.com/", nil); got != "https://example.com/" {
+		t.Errorf("MergeQuery with no parameters changed the URL to %s", got)
+	}
+}
+
+func TestLinkParams(t *testing.T) {
+	w, err := spmta.NewWrapper(RandomBaseURL(), true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SetLinkParams("utm_source=email&utm_campaign={{.Campaign}}&utm_content={{.MessageID}}"); err != nil {
+		t.Fatal(err)
+	}
+	msgID := spmta.UniqMessageID()
+	w.SetMessageInfo(msgID, RandomRecipient())
+	check := func(target, expected string) {
+		t.Helper()
+		_, wd, _, err := spmta.DecodeLink(w.WrapURL(target))
+		if err != nil || wd.TargetLinkURL != expected {
+			t.Errorf("Wrapped %s decoded to %s %v, expected %s", target, wd.TargetLinkURL, err, expected)
+		}
+	}
+	// Blank campaign is left out
+	check("https://example.com/page", "https://example.com/page?utm_content="+msgID+"&utm_source=email")
+	w.SetCampaign("spring sale")
+	check("https://example.com/page?utm_source=web", "https://example.com/page?utm_source=web&utm_campaign=spring+sale&utm_content="+msgID)
+	// Opens and non-web links are unaffected
+	check("mailto:bob@example.com", "mailto:bob@example.com")
+	if err = w.SetLinkParams(""); err != nil {
+		t.Error(err)
+	}
+	check("https://example.com/page", "https://example.com/page")
+
+	for _, faulty := range []string{"utm_campaign={{.Campaign", "utm_campaign={{.NoSuchField}}", "a=%zz"} {
+		if err = w.SetLinkParams(faulty); err == nil {
+			t.Errorf("Expected error from %s", faulty)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package sparkypmtatracking
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// LinkStore keeps link data on the server side, so that short links need carry only an id
+type LinkStore interface {
+	SaveLink(id string, wd WrapperData) error
+	LoadLink(id string) (WrapperData, error)
+}
+
+// ErrLinkNotFound is returned by LoadLink when there is no data for the id, e.g. because it has expired
+var ErrLinkNotFound = errors.New("Link not found")
+
+// LinkPrefix is the prefix for Redis keys holding short link data
+const LinkPrefix = "link_"
+
+// LinkTTL defines the time-to-live for short link data. Links in mail are clicked for months after sending.
+const LinkTTL = time.Duration(time.Hour * 24 * 180)
+
+// linkID returns the id for a short link. It's derived from the link data, so the same link in a message gets the same id.
+func linkID(pathData []byte) string {
+	h := sha256.Sum256(pathData)
+	return base64.RawURLEncoding.EncodeToString(h[:12])
+}
+
+// RedisLinkStore keeps short link data in Redis
+type RedisLinkStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewRedisLinkStore returns a link store using client, with link data expiring after ttl
+func NewRedisLinkStore(client *redis.Client, ttl time.Duration) *RedisLinkStore {
+	return &RedisLinkStore{client: client, ttl: ttl}
+}
+
+// SaveLink stores the link data under id
+func (s *RedisLinkStore) SaveLink(id string, wd WrapperData) error {
+	wdJSON, err := json.Marshal(wd)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Set(LinkPrefix+id, wdJSON, s.ttl).Result()
+	return err
+}
+
+// LoadLink returns the link data stored under id
+func (s *RedisLinkStore) LoadLink(id string) (WrapperData, error) {
+	var wd WrapperData
+	wdJSON, err := s.client.Get(LinkPrefix + id).Result()
+	if err == redis.Nil {
+		return wd, ErrLinkNotFound
+	}
+	if err != nil {
+		return wd, err
+	}
+	err = json.Unmarshal([]byte(wdJSON), &wd)
+	return wd, err
+}
+
+// MemoryLinkStore keeps short link data in memory, for testing and single-process use
+type MemoryLinkStore struct {
+	mu    sync.Mutex
+	links map[string]WrapperData
+}
+
+// NewMemoryLinkStore returns an empty in-memory link store
+func NewMemoryLinkStore() *MemoryLinkStore {
+	return &MemoryLinkStore{links: make(map[string]WrapperData)}
+}
+
+// SaveLink stores the link data under id
+func (s *MemoryLinkStore) SaveLink(id string, wd WrapperData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.links[id] = wd
+	return nil
+}
+
+// LoadLink returns the link data stored under id
+func (s *MemoryLinkStore) LoadLink(id string) (WrapperData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wd, ok := s.links[id]
+	if !ok {
+		return wd, ErrLinkNotFound
+	}
+	return wd, nil
+}
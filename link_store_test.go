@@ -0,0 +1,85 @@
+package sparkypmtatracking_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+func TestShortLinks(t *testing.T) {
+	store := spmta.NewMemoryLinkStore()
+	trackingURL := RandomBaseURL()
+	w, err := spmta.NewWrapper(trackingURL, true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetLinkStore(store)
+	msgID := spmta.UniqMessageID()
+	recip := RandomRecipient()
+	w.SetMessageInfo(msgID, recip)
+	target := RandomURLWithPath()
+	link := w.WrapURL(target)
+	if !strings.HasPrefix(link, trackingURL+"/s/") || len(link) != len(trackingURL)+len("/s/")+16 {
+		t.Errorf("Unexpected short link %s", link)
+	}
+	if strings.Contains(link, recip) {
+		t.Errorf("Short link should not carry recipient")
+	}
+	// Same link in the same message gets the same id
+	if link2 := w.WrapURL(target); link2 != link {
+		t.Errorf("Expected same link, got %s and %s", link, link2)
+	}
+	_, wd, domain, err := spmta.ResolveLink(link, store, nil)
+	if err != nil || wd.TargetLinkURL != target || wd.MessageID != msgID || wd.RcptTo != recip || wd.Action != "c" || domain != trackingURL {
+		t.Errorf("ResolveLink returned %v %s %v", wd, domain, err)
+	}
+	// Full links still resolve
+	full, err := spmta.EncodeLink(trackingURL, "open", msgID, recip, "", true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, wd, _, err = spmta.ResolveLink(full, store, nil); err != nil || wd.Action != "o" {
+		t.Errorf("ResolveLink of full link returned %v %v", wd, err)
+	}
+	// Errors
+	if _, _, _, err = spmta.ResolveLink(trackingURL+"/s/AAAAAAAAAAAAAAAA", store, nil); err != spmta.ErrLinkNotFound {
+		t.Errorf("Expected link not found, got %v", err)
+	}
+	if _, _, _, err = spmta.ResolveLink(link, nil, nil); err == nil {
+		t.Errorf("Expected error with no link store")
+	}
+
+	// Signed short links
+	key := "a signing key"
+	w.SetSigningKey(key)
+	signed := w.WrapURL(target)
+	if err = spmta.VerifyLink(signed, []byte(key)); err != nil {
+		t.Error(err)
+	}
+	if _, wd, _, err = spmta.ResolveLink(signed, store, nil); err != nil || wd.TargetLinkURL != target {
+		t.Errorf("ResolveLink of signed link returned %v %v", wd, err)
+	}
+}
+
+func TestRedisLinkStore(t *testing.T) {
+	client := spmta.MyRedis()
+	store := spmta.NewRedisLinkStore(client, time.Minute)
+	wd := spmta.WrapperData{Action: "c", TargetLinkURL: RandomURLWithPath(), MessageID: spmta.UniqMessageID(), RcptTo: RandomRecipient()}
+	id := RandomWord()
+	if err := store.SaveLink(id, wd); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Del(spmta.LinkPrefix + id)
+	got, err := store.LoadLink(id)
+	if err != nil || got != wd {
+		t.Errorf("LoadLink returned %v %v, expected %v", got, err, wd)
+	}
+	if ttl := client.TTL(spmta.LinkPrefix + id).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Unexpected TTL %v", ttl)
+	}
+	if _, err = store.LoadLink(id + "_nonexistent"); err != spmta.ErrLinkNotFound {
+		t.Errorf("Expected link not found, got %v", err)
+	}
+}
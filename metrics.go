@@ -0,0 +1,166 @@
+package sparkypmtatracking
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsServer returns a server for the Prometheus /metrics endpoint, to run on its own listen address
+func MetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+// ServeMetrics starts a MetricsServer on addr in the background, returning it so it can be shut down.
+// If addr is empty, no metrics are served and nil is returned.
+func ServeMetrics(addr string) *http.Server {
+	if addr == "" {
+		return nil
+	}
+	srv := MetricsServer(addr)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Metrics server error", "addr", addr, "error", err)
+		}
+	}()
+	slog.Info("Serving metrics", "addr", addr, "path", "/metrics")
+	return srv
+}
+
+// TrackerEvents counts opens and clicks queued by the tracker, by event type
+var TrackerEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tracker_events_total",
+	Help: "Tracking events queued, by type (open, initial_open, click).",
+}, []string{"type"})
+
+// TrackerEventsDropped counts events dropped because the queue was full, by reason
+var TrackerEventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tracker_events_dropped_total",
+	Help: "Tracking events dropped because the queue was full, by reason (drop_oldest, drop_newest, spill_error).",
+}, []string{"reason"})
+
+// TrackerEventsSpilled counts events written to the spill file because the queue was full
+var TrackerEventsSpilled = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "tracker_events_spilled_total",
+	Help: "Tracking events written to the spill file because the queue was full.",
+})
+
+// RedirectsBlocked counts clicks not redirected straight to their target, by reason
+var RedirectsBlocked = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tracker_redirects_blocked_total",
+	Help: "Clicks not redirected straight to their target URL, by reason.",
+}, []string{"reason"})
+
+// LinkErrors counts tracking requests with links that could not be used, by reason
+var LinkErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tracker_link_errors_total",
+	Help: "Tracking requests with links that could not be decoded or verified, by reason.",
+}, []string{"reason"})
+
+// LinksRepaired counts damaged links that were recovered, by kind of repair
+var LinksRepaired = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tracker_links_repaired_total",
+	Help: "Damaged tracking links that were recovered, by kind of repair.",
+}, []string{"kind"})
+
+// FeedQueueDepth is the length of the Redis event queue, as last seen by the feeder
+var FeedQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "feeder_queue_depth",
+	Help: "Events waiting in the Redis queue, as last seen by the feeder.",
+})
+
+// FeedBatchEvents records the number of events in each batch sent
+var FeedBatchEvents = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "feeder_batch_events",
+	Help:    "Events in each batch sent.",
+	Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+})
+
+// FeedBatchSeconds records the time taken to send each batch to all the event sinks
+var FeedBatchSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "feeder_batch_duration_seconds",
+	Help:    "Time taken to send each batch to all the event sinks.",
+	Buckets: prometheus.DefBuckets,
+})
+
+// FeedBatchFailures counts batches that at least one event sink did not accept
+var FeedBatchFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "feeder_batch_failures_total",
+	Help: "Batches that could not be sent to, or were rejected by, at least one event sink.",
+})
+
+// FeedSinkFailures counts batches not accepted, by event sink
+var FeedSinkFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feeder_sink_failures_total",
+	Help: "Batches that could not be sent to, or were rejected by, each event sink (sparkpost, webhook, file, kafka, stdout, archive).",
+}, []string{"sink"})
+
+// FeedBatchesInFlight is the number of batches being sent at once
+var FeedBatchesInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "feeder_batches_in_flight",
+	Help: "Batches being sent to the event sinks now, up to the number of feeder workers.",
+})
+
+// FeedDuplicates counts events dropped as duplicates, by event type
+var FeedDuplicates = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "feeder_duplicates_total",
+	Help: "Events dropped as duplicates of one already sent, by event type (open, initial_open, click).",
+}, []string{"type"})
+
+// FeedClaimed counts events claimed from the Redis stream after being left pending by another feeder
+var FeedClaimed = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "feeder_claimed_total",
+	Help: "Events claimed from the Redis stream after being left pending too long by a feeder.",
+})
+
+// FeedConsumerPending is the number of events taken by each feeder in the consumer group and not yet sent
+var FeedConsumerPending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "feeder_consumer_pending",
+	Help: "Events taken from the Redis stream and not yet sent, by feeder in the consumer group.",
+}, []string{"consumer"})
+
+// FeedConsumerIdle is the time since each feeder in the consumer group last read the stream
+var FeedConsumerIdle = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "feeder_consumer_idle_seconds",
+	Help: "Time since each feeder in the consumer group last read the Redis stream.",
+}, []string{"consumer"})
+
+// WrapperSessions counts SMTP sessions, by result of connecting upstream
+var WrapperSessions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "wrapper_sessions_total",
+	Help: "SMTP sessions started, by result (ok, upstream_error, shutting_down).",
+}, []string{"result"})
+
+// WrapperMessages counts messages relayed, by result
+var WrapperMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "wrapper_messages_total",
+	Help: "Messages passed through the DATA phase, by result (ok, error).",
+}, []string{"result"})
+
+// WrapperUpstreamResponses counts upstream server responses to message DATA, by SMTP reply code
+var WrapperUpstreamResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "wrapper_upstream_responses_total",
+	Help: "Upstream server responses to message DATA, by SMTP reply code.",
+}, []string{"code"})
+
+// ETLRecords counts accounting records processed, by record type
+var ETLRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "acct_etl_records_total",
+	Help: "PowerMTA accounting records loaded into Redis, by record type (header, delivery).",
+}, []string{"type"})
+
+// ETLErrors counts accounting records that could not be processed
+var ETLErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "acct_etl_errors_total",
+	Help: "PowerMTA accounting records that could not be processed.",
+})
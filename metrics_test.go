@@ -0,0 +1,42 @@
+package sparkypmtatracking_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+func TestMetricsServer(t *testing.T) {
+	if spmta.ServeMetrics("") != nil {
+		t.Errorf("Expected no metrics server without an address")
+	}
+	srv := httptest.NewServer(spmta.MetricsServer("").Handler)
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []string{"feeder_queue_depth", "feeder_batch_events", "acct_etl_errors_total", "go_goroutines"} {
+		if !strings.Contains(string(body), m) {
+			t.Errorf("Metric %s missing from /metrics", m)
+		}
+	}
+	// Tracking paths are not served here
+	res, err = http.Get(srv.URL + "/v1/eJx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", res.StatusCode)
+	}
+}
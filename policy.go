@@ -0,0 +1,144 @@
+package sparkypmtatracking
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+// PolicyRule maps a message sender to tracking settings. Each non-blank match field must be satisfied for the rule to apply.
+// A blank TrackingURL means messages matching this rule are not tracked.
+type PolicyRule struct {
+	MailFromDomain   string `json:"mail_from_domain"` // matches the SMTP MAIL FROM address domain
+	FromDomain       string `json:"from_domain"`      // matches the From: header address domain
+	AuthUser         string `json:"auth_user"`        // matches the SMTP AUTH username
+	TrackingURL      string `json:"tracking_url"`
+	TrackOpen        bool   `json:"track_open"`
+	TrackInitialOpen bool   `json:"track_initial_open"`
+	TrackLink        bool   `json:"track_click"`
+	SigningKey       string `json:"signing_key"`
+	ShortLinks       bool   `json:"short_links"`
+	LinkParams       string `json:"link_params"` // query parameters added to target links, e.g. utm_source=email
+	wrapper          *Wrapper
+}
+
+// Policy holds an ordered list of rules. The first matching rule wins.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// LoadPolicy reads a JSON policy file
+func LoadPolicy(filename string) (*Policy, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadPolicy(f)
+}
+
+// ReadPolicy reads JSON policy rules from r, checks them and prepares the wrapper for each rule
+func ReadPolicy(r io.Reader) (*Policy, error) {
+	var p Policy
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, err
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.MailFromDomain == "" && rule.FromDomain == "" && rule.AuthUser == "" {
+			return nil, fmt.Errorf("Policy rule %d has no mail_from_domain, from_domain or auth_user to match", i)
+		}
+		if rule.TrackingURL == "" {
+			continue // messages matching this rule are not tracked
+		}
+		w, err := NewWrapper(rule.TrackingURL, rule.TrackOpen, rule.TrackInitialOpen, rule.TrackLink)
+		if err != nil {
+			return nil, fmt.Errorf("Policy rule %d: %v", i, err)
+		}
+		w.SetSigningKey(rule.SigningKey)
+		if err = w.SetLinkParams(rule.LinkParams); err != nil {
+			return nil, fmt.Errorf("Policy rule %d: %v", i, err)
+		}
+		rule.wrapper = w
+	}
+	return &p, nil
+}
+
+// setLinkStore gives the wrappers for rules with short_links set their link store
+func (p *Policy) setLinkStore(store LinkStore) error {
+	for i, rule := range p.Rules {
+		if rule.ShortLinks && rule.wrapper != nil {
+			if store == nil {
+				return fmt.Errorf("Policy rule %d: short_links needs a link store", i)
+			}
+			rule.wrapper.SetLinkStore(store)
+		}
+	}
+	return nil
+}
+
+// setLinkKeys makes the wrappers for all rules encrypt link data with keys
+func (p *Policy) setLinkKeys(keys *LinkKeys) {
+	for _, rule := range p.Rules {
+		rule.wrapper.SetLinkKeys(keys)
+	}
+}
+
+// Match returns the wrapper for the first rule matching the given sender attributes, and whether a rule was matched.
+// mailFrom is the SMTP MAIL FROM address, fromHeader is the raw From: header value.
+func (p *Policy) Match(authUser, mailFrom, fromHeader string) (*Wrapper, bool) {
+	if p == nil {
+		return nil, false
+	}
+	mailFromDomain := addressDomain(mailFrom)
+	fromDomain := ""
+	if addr, err := mail.ParseAddress(fromHeader); err == nil {
+		fromDomain = addressDomain(addr.Address)
+	}
+	for _, rule := range p.Rules {
+		if rule.MailFromDomain != "" && !strings.EqualFold(rule.MailFromDomain, mailFromDomain) {
+			continue
+		}
+		if rule.FromDomain != "" && !strings.EqualFold(rule.FromDomain, fromDomain) {
+			continue
+		}
+		if rule.AuthUser != "" && rule.AuthUser != authUser {
+			continue
+		}
+		return rule.wrapper, true
+	}
+	return nil, false
+}
+
+// addressDomain returns the part of an email address after the @, or empty string if not found
+func addressDomain(addr string) string {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSuffix(addr[i+1:], ">")
+}
+
+// mailFromAddress returns the address from the argument of a MAIL command, e.g. FROM:<bob@example.com> SIZE=1234
+func mailFromAddress(arg string) (string, error) {
+	if len(arg) < 5 || !strings.EqualFold(arg[:5], "FROM:") {
+		return "", errors.New("MAIL command argument does not start with FROM:")
+	}
+	a := strings.TrimSpace(arg[5:])
+	if strings.HasPrefix(a, "<") {
+		end := strings.Index(a, ">")
+		if end < 0 {
+			return "", errors.New("MAIL command argument has unterminated address")
+		}
+		return a[1:end], nil
+	}
+	f := strings.Fields(a)
+	if len(f) == 0 {
+		return "", nil
+	}
+	return f[0], nil
+}
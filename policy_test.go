@@ -0,0 +1,77 @@
+package sparkypmtatracking_test
+
+import (
+	"strings"
+	"testing"
+
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+const testPolicy = `{
+	"rules": [
+		{"from_domain": "brand-one.example.com", "tracking_url": "https://track.brand-one.example.com", "track_open": true, "track_click": true},
+		{"mail_from_domain": "brand-two.example.com", "auth_user": "brand2", "tracking_url": "https://track.brand-two.example.com", "track_initial_open": true},
+		{"auth_user": "untracked", "tracking_url": ""}
+	]
+}`
+
+func TestPolicyMatch(t *testing.T) {
+	p, err := spmta.ReadPolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type matchCase struct {
+		authUser, mailFrom, fromHeader string
+		found                          bool
+		trackingURL                    string
+	}
+	cases := []matchCase{
+		{"", "", "Bob <bob@brand-one.example.com>", true, "https://track.brand-one.example.com"},
+		{"", "", "Bob <bob@BRAND-ONE.example.com>", true, "https://track.brand-one.example.com"},
+		{"brand2", "bounce@brand-two.example.com", "", true, "https://track.brand-two.example.com"},
+		{"someone", "bounce@brand-two.example.com", "", false, ""}, // both criteria must match
+		{"untracked", "", "", true, ""},
+		{"", "", "not an address", false, ""},
+	}
+	for _, c := range cases {
+		w, found := p.Match(c.authUser, c.mailFrom, c.fromHeader)
+		if found != c.found {
+			t.Errorf("Match(%q, %q, %q) found=%v, expected %v", c.authUser, c.mailFrom, c.fromHeader, found, c.found)
+		}
+		if c.trackingURL == "" {
+			if w.Active() {
+				t.Errorf("Match(%q, %q, %q) returned an active wrapper", c.authUser, c.mailFrom, c.fromHeader)
+			}
+		} else if w.URL.String() != c.trackingURL {
+			t.Errorf("Match(%q, %q, %q) returned tracking URL %s, expected %s", c.authUser, c.mailFrom, c.fromHeader, w.URL.String(), c.trackingURL)
+		}
+	}
+	// nil policy never matches
+	var np *spmta.Policy
+	if _, found := np.Match("brand2", "", ""); found {
+		t.Errorf("nil policy should not match")
+	}
+}
+
+func TestPolicyFaultyInputs(t *testing.T) {
+	eList := [][]string{
+		{"unexpected EOF", `{"rules": [`},
+		{"no mail_from_domain, from_domain or auth_user", `{"rules": [{"tracking_url": "https://example.com"}]}`},
+		{"invalid URI", `{"rules": [{"auth_user": "x", "tracking_url": "example.com"}]}`},
+		{"Link parameter utm_campaign", `{"rules": [{"auth_user": "x", "tracking_url": "https://example.com", "link_params": "utm_campaign={{.Campaign"}]}`},
+	}
+	for _, e := range eList {
+		_, err := spmta.ReadPolicy(strings.NewReader(e[1]))
+		if err == nil || !strings.Contains(err.Error(), e[0]) {
+			t.Errorf("Expected error containing %q, got %v", e[0], err)
+		}
+	}
+	_, err := spmta.LoadPolicy("this_file_does_not_exist.json")
+	if err == nil {
+		t.Errorf("Expected error loading nonexistent file")
+	}
+	p, err := spmta.LoadPolicy("etc/wrapper/policy.example.json")
+	if err != nil || len(p.Rules) != 3 {
+		t.Errorf("Example policy file did not load: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package sparkypmtatracking
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/go-redis/redis"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// What the tracker does with events arriving when the queue is full
+const (
+	OverflowDropOldest = "drop_oldest" // queue the event, dropping the oldest waiting
+	OverflowDropNewest = "drop_newest" // drop the event
+	OverflowSpill      = "spill"       // append the event to a local file instead
+)
+
+// QueueLimit caps the number of events waiting for the feeders, so the queue can't grow without bound while they
+// are stopped. Events arriving when the queue is full are dropped or spilled per Policy; the tracker still answers
+// the request as usual.
+type QueueLimit struct {
+	MaxLen int64
+	Policy string
+	spill  *lumberjack.Logger
+}
+
+// NewQueueLimit returns a limit of maxLen events, with the policy for events arriving when the queue is full. With
+// OverflowSpill, events are appended to spillFile as NDJSON, in the queue's own format, rotated every 100 megabytes.
+func NewQueueLimit(maxLen int64, policy, spillFile string) (*QueueLimit, error) {
+	if maxLen <= 0 {
+		return nil, fmt.Errorf("queue limit %d must be more than 0", maxLen)
+	}
+	l := &QueueLimit{MaxLen: maxLen, Policy: policy}
+	switch policy {
+	case OverflowDropOldest, OverflowDropNewest:
+	case OverflowSpill:
+		if spillFile == "" {
+			return nil, fmt.Errorf("overflow policy %s needs a file", policy)
+		}
+		l.spill = &lumberjack.Logger{Filename: spillFile, MaxSize: 100} // rotated files are kept, to put back on the queue
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q", policy)
+	}
+	return l, nil
+}
+
+// Close closes the spill file, if any
+func (l *QueueLimit) Close() error {
+	if l.spill == nil {
+		return nil
+	}
+	return l.spill.Close()
+}
+
+// push adds an event to the queue
+func (t *Tracker) push(client *redis.Client, eBytes []byte) error {
+	if t.Stream {
+		return client.XAdd(&redis.XAddArgs{Stream: RedisStream, Values: map[string]interface{}{streamField: eBytes}}).Err()
+	}
+	return client.RPush(RedisQueue, eBytes).Err()
+}
+
+// enqueueListScript pushes event ARGV[1] onto the list KEYS[1], if fewer than ARGV[2] events are waiting there and on
+// the retry list KEYS[2]. With policy ARGV[3] drop_oldest, a full list is trimmed to make room instead.
+// Returns 1 if the event was queued, the number of events waiting before, and the number dropped.
+var enqueueListScript = redis.NewScript(`
+local maxLen, policy = tonumber(ARGV[2]), ARGV[3]
+local n = redis.call('LLEN', KEYS[1]) + redis.call('LLEN', KEYS[2])
+if n >= maxLen and policy ~= 'drop_oldest' then
+	return {0, n, 0}
+end
+local queued = redis.call('RPUSH', KEYS[1], ARGV[1])
+local keep = maxLen - redis.call('LLEN', KEYS[2])
+if keep < 1 then
+	keep = 1
+end
+if queued <= keep then
+	return {1, n, 0}
+end
+redis.call('LTRIM', KEYS[1], -keep, -1)
+return {1, n, queued - keep}
+`)
+
+// enqueueStreamScript adds event ARGV[1] to the stream KEYS[1] as field ARGV[4], if fewer than ARGV[2] entries are
+// waiting, not yet taken by consumer group ARGV[5]. With policy ARGV[3] drop_oldest, once more than ARGV[6] entries
+// over the limit are waiting, the oldest waiting are deleted to leave the limit, never those pending for a consumer.
+// XADD MAXLEN is not used, as it would also trim entries pending for a consumer.
+// Returns 1 if the event was queued, the number of entries waiting before, and the number dropped.
+var enqueueStreamScript = redis.NewScript(`
+local maxLen, policy, slack = tonumber(ARGV[2]), ARGV[3], tonumber(ARGV[6])
+local n, lastTaken = redis.call('XLEN', KEYS[1]), ''
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	for _, g in ipairs(redis.call('XINFO', 'GROUPS', KEYS[1])) do
+		local info = {}
+		for i = 1, #g, 2 do
+			info[g[i]] = g[i + 1]
+		end
+		if info['name'] == ARGV[5] then
+			n = n - info['pending']
+			lastTaken = info['last-delivered-id']
+		end
+	end
+end
+if n >= maxLen and policy ~= 'drop_oldest' then
+	return {0, n, 0}
+end
+redis.call('XADD', KEYS[1], '*', ARGV[4], ARGV[1])
+local drop = n + 1 - maxLen
+if drop <= slack then
+	return {1, n, 0}
+end
+local start = '-'
+if lastTaken ~= '' then
+	start = lastTaken -- XRANGE includes it, if it is still in the stream
+end
+local ids = {}
+for _, m in ipairs(redis.call('XRANGE', KEYS[1], start, '+', 'COUNT', drop + 1)) do
+	if m[1] ~= lastTaken and #ids < drop then
+		table.insert(ids, m[1])
+	end
+end
+if #ids > 0 then
+	redis.call('XDEL', KEYS[1], unpack(ids))
+end
+return {1, n, #ids}
+`)
+
+// enqueue passes an event to the feeders, applying the queue limit. The limit is checked, and the event queued, in
+// one script, so trackers sharing the queue can't overshoot it. Returns false if the event was dropped or spilled,
+// rather than queued.
+func (t *Tracker) enqueue(client *redis.Client, eBytes []byte) (bool, error) {
+	l := t.Limit
+	if l == nil {
+		return true, t.push(client, eBytes)
+	}
+	var res interface{}
+	var err error
+	if t.Stream {
+		// Trim a large stream in steps of 1% of the limit, like XADD MAXLEN ~, rather than on every event
+		res, err = enqueueStreamScript.Run(client, []string{RedisStream}, eBytes, l.MaxLen, l.Policy, streamField,
+			FeederGroup, l.MaxLen/100).Result()
+	} else {
+		res, err = enqueueListScript.Run(client, []string{RedisQueue, RedisRetryQueue}, eBytes, l.MaxLen, l.Policy).Result()
+	}
+	if err != nil {
+		return false, err
+	}
+	r, ok := res.([]interface{})
+	if !ok || len(r) != 3 {
+		return false, fmt.Errorf("unexpected enqueue script reply %v", res)
+	}
+	queued, _ := r[0].(int64)
+	n, _ := r[1].(int64)
+	dropped, _ := r[2].(int64)
+	if queued == 1 {
+		if dropped > 0 {
+			slog.Debug("Queue full, oldest events dropped", "queue_length", n)
+			TrackerEventsDropped.WithLabelValues(OverflowDropOldest).Add(float64(dropped))
+		}
+		return true, nil
+	}
+	switch l.Policy {
+	case OverflowSpill:
+		if _, err = l.spill.Write(append(eBytes, '\n')); err != nil {
+			// The event is lost, but that's no reason to fail the request
+			slog.Error("Spill file error", "file", l.spill.Filename, "error", err)
+			TrackerEventsDropped.WithLabelValues("spill_error").Inc()
+			return false, nil
+		}
+		slog.Debug("Queue full, event spilled", "queue_length", n, "file", l.spill.Filename)
+		TrackerEventsSpilled.Inc()
+		return false, nil
+	default:
+		slog.Debug("Queue full, event dropped", "queue_length", n)
+		TrackerEventsDropped.WithLabelValues(OverflowDropNewest).Inc()
+		return false, nil
+	}
+}
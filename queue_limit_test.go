@@ -0,0 +1,221 @@
+package sparkypmtatracking_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+func TestNewQueueLimitFaultyInputs(t *testing.T) {
+	for _, c := range []struct {
+		maxLen          int64
+		policy, file    string
+		wantErrContains string
+	}{
+		{0, spmta.OverflowDropOldest, "", "more than 0"},
+		{10, "drop_everything", "", "unknown overflow policy"},
+		{10, spmta.OverflowSpill, "", "needs a file"},
+	} {
+		if _, err := spmta.NewQueueLimit(c.maxLen, c.policy, c.file); err == nil || !strings.Contains(err.Error(), c.wantErrContains) {
+			t.Errorf("%+v: unexpected error %v", c, err)
+		}
+	}
+}
+
+// trackOpens requests an open pixel for each message, checking the pixel is always served
+func trackOpens(t *testing.T, tracker *spmta.Tracker, msgIDs []string) {
+	for _, msgID := range msgIDs {
+		link, err := spmta.EncodeLink(RandomBaseURL(), "open", msgID, RandomRecipient(), "", true, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		tracker.ServeHTTP(rr, httptest.NewRequest("GET", link, nil))
+		if rr.Code != http.StatusOK || rr.Body.String() != string(spmta.TransparentGif) {
+			t.Errorf("Message %s: expected pixel, got status %d", msgID, rr.Code)
+		}
+	}
+}
+
+// queuedMsgIDs returns the message IDs of the events in the queue, or the stream, in order
+func queuedMsgIDs(t *testing.T, client *redis.Client, stream bool) string {
+	var entries []string
+	if stream {
+		msgs, err := client.XRange(spmta.RedisStream, "-", "+").Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range msgs {
+			entries = append(entries, m.Values["event"].(string))
+		}
+	} else {
+		entries = client.LRange(spmta.RedisQueue, 0, -1).Val()
+	}
+	var ids []string
+	for _, e := range entries {
+		var tev spmta.TrackEvent
+		if err := json.Unmarshal([]byte(e), &tev); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, tev.WD.MessageID)
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestTrackerQueueLimit(t *testing.T) {
+	client := spmta.MyRedis()
+	msgIDs := []string{"m1", "m2", "m3", "m4", "m5"}
+	for _, c := range []struct {
+		policy  string
+		stream  bool
+		want    string
+		dropped float64
+	}{
+		{spmta.OverflowDropOldest, false, "m3 m4 m5", 2},
+		{spmta.OverflowDropOldest, true, "m3 m4 m5", 2},
+		{spmta.OverflowDropNewest, false, "m1 m2 m3", 2},
+		{spmta.OverflowDropNewest, true, "m1 m2 m3", 2},
+	} {
+		emptyRedisQueue(client)
+		emptyRedisStream(t, client)
+		limit, err := spmta.NewQueueLimit(3, c.policy, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracker := spmta.NewTracker(nil)
+		tracker.Stream, tracker.Limit = c.stream, limit
+		before := testutil.ToFloat64(spmta.TrackerEventsDropped.WithLabelValues(c.policy))
+		trackOpens(t, tracker, msgIDs)
+		if got := queuedMsgIDs(t, client, c.stream); got != c.want {
+			t.Errorf("%s stream=%v: queued %s, want %s", c.policy, c.stream, got, c.want)
+		}
+		if dropped := testutil.ToFloat64(spmta.TrackerEventsDropped.WithLabelValues(c.policy)) - before; dropped != c.dropped {
+			t.Errorf("%s stream=%v: %v events dropped, want %v", c.policy, c.stream, dropped, c.dropped)
+		}
+	}
+	emptyRedisQueue(client)
+}
+
+// Trackers sharing the queue don't overshoot the limit, and events put back for the feeder to retry are counted
+func TestTrackerQueueLimitShared(t *testing.T) {
+	client := spmta.MyRedis()
+	for _, stream := range []bool{false, true} {
+		emptyRedisQueue(client)
+		emptyRedisStream(t, client)
+		limit, err := spmta.NewQueueLimit(10, spmta.OverflowDropNewest, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			tracker := spmta.NewTracker(nil)
+			tracker.Stream, tracker.Limit = stream, limit
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				trackOpens(t, tracker, []string{"a" + fmt.Sprint(i), "b" + fmt.Sprint(i), "c" + fmt.Sprint(i), "d" + fmt.Sprint(i)})
+			}(i)
+		}
+		wg.Wait()
+		if got := strings.Fields(queuedMsgIDs(t, client, stream)); len(got) != 10 {
+			t.Errorf("stream=%v: expected 10 events queued, got %d", stream, len(got))
+		}
+	}
+
+	emptyRedisQueue(client)
+	if err := client.RPush(spmta.RedisRetryQueue, "retry1", "retry2").Err(); err != nil {
+		t.Fatal(err)
+	}
+	limit, err := spmta.NewQueueLimit(3, spmta.OverflowDropOldest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := spmta.NewTracker(nil)
+	tracker.Limit = limit
+	trackOpens(t, tracker, []string{"m1", "m2"})
+	if got := queuedMsgIDs(t, client, false); got != "m2" {
+		t.Errorf("Queued %s", got)
+	}
+	emptyRedisQueue(client)
+}
+
+// With the stream, events a feeder has taken are not counted, or dropped
+func TestTrackerQueueLimitPending(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisStream(t, client)
+	limit, err := spmta.NewQueueLimit(3, spmta.OverflowDropOldest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := spmta.NewTracker(nil)
+	tracker.Stream, tracker.Limit = true, limit
+	trackOpens(t, tracker, []string{"m1", "m2"})
+	f := spmta.Feeder{Client: client, Sink: failSink{}, Consumer: "feeder-1"}
+	if err = f.FeedEvents(context.Background()); err == nil {
+		t.Fatal("Expected sink error")
+	}
+	before := testutil.ToFloat64(spmta.TrackerEventsDropped.WithLabelValues(spmta.OverflowDropOldest))
+	trackOpens(t, tracker, []string{"m3", "m4", "m5", "m6", "m7"})
+	if got := queuedMsgIDs(t, client, true); got != "m1 m2 m5 m6 m7" {
+		t.Errorf("Queued %s", got)
+	}
+	if dropped := testutil.ToFloat64(spmta.TrackerEventsDropped.WithLabelValues(spmta.OverflowDropOldest)) - before; dropped != 2 {
+		t.Errorf("Expected 2 events dropped, got %v", dropped)
+	}
+	pending, err := client.XPending(spmta.RedisStream, spmta.FeederGroup).Result()
+	if err != nil || pending.Count != 2 {
+		t.Errorf("Expected 2 events pending, got %+v %v", pending, err)
+	}
+}
+
+func TestTrackerQueueSpill(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisQueue(client)
+	spillFile := filepath.Join(t.TempDir(), "spill.ndjson")
+	limit, err := spmta.NewQueueLimit(3, spmta.OverflowSpill, spillFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer limit.Close()
+	tracker := spmta.NewTracker(nil)
+	tracker.Limit = limit
+	before := testutil.ToFloat64(spmta.TrackerEventsSpilled)
+	trackOpens(t, tracker, []string{"m1", "m2", "m3", "m4", "m5"})
+	if got := queuedMsgIDs(t, client, false); got != "m1 m2 m3" {
+		t.Errorf("Queued %s", got)
+	}
+	if spilled := testutil.ToFloat64(spmta.TrackerEventsSpilled) - before; spilled != 2 {
+		t.Errorf("Expected 2 events spilled, got %v", spilled)
+	}
+	// Spilled events are in the queue's own format, one per line, so they can be put back on the queue
+	f, err := os.Open(spillFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ids []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var tev spmta.TrackEvent
+		if err = json.Unmarshal(scanner.Bytes(), &tev); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, tev.WD.MessageID)
+	}
+	if got := strings.Join(ids, " "); got != "m4 m5" {
+		t.Errorf("Spilled %s", got)
+	}
+	emptyRedisQueue(client)
+}
@@ -0,0 +1,403 @@
+package sparkypmtatracking
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// EventBatch is a batch of events taken from the Redis queue, to be sent to each EventSink
+type EventBatch struct {
+	Events []SparkPostEvent
+	NDJSON []byte // the same events, one per line, in SparkPost Ingest format, so without the first open and click flags
+}
+
+// MessageIDs returns the message ID of each event in the batch
+func (b *EventBatch) MessageIDs() []string {
+	ids := make([]string, len(b.Events))
+	for i, e := range b.Events {
+		ids[i] = e.EventWrapper.EventGrouping.MessageID
+	}
+	return ids
+}
+
+// EventSink is a destination the feeder sends batches of open and click events to
+type EventSink interface {
+	Name() string
+	Send(ctx context.Context, b *EventBatch) error
+	Close() error
+}
+
+// Names of the event sinks, as selected on the feeder command line
+const (
+	SinkSparkPost = "sparkpost"
+	SinkWebhook   = "webhook"
+	SinkFile      = "file"
+	SinkKafka     = "kafka"
+	SinkStdout    = "stdout"
+)
+
+// sendTo sends b to sink in a trace span, counting failures. Each sink in a MultiSink is counted separately.
+func sendTo(ctx context.Context, sink EventSink, b *EventBatch) (err error) {
+	if m, ok := sink.(MultiSink); ok {
+		return m.Send(ctx, b)
+	}
+	ctx, span := tracer.Start(ctx, "feeder.send", trace.WithAttributes(attribute.String("sink", sink.Name()),
+		attribute.Int("events", len(b.Events))))
+	defer func() { endSpan(span, err) }()
+	if err = sink.Send(ctx, b); err != nil {
+		FeedSinkFailures.WithLabelValues(sink.Name()).Inc()
+		return fmt.Errorf("%s: %w", sink.Name(), err)
+	}
+	return nil
+}
+
+// MultiSink sends each batch to all of its sinks. The first is the main sink: if it fails, so does the batch, to be sent
+// again later. The others are sent the batch once the main sink has accepted it, so they don't get it twice. If one of
+// them fails, that is logged and counted, and the batch is not sent to it again, so it does not stop the others.
+type MultiSink []EventSink
+
+// Name returns the names of the sinks, comma-separated
+func (m MultiSink) Name() string {
+	names := make([]string, len(m))
+	for i, s := range m {
+		names[i] = s.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// Send sends b to the main sink, then to the others all at once, so a slow sink does not hold up the others.
+// Returns the error from the main sink.
+func (m MultiSink) Send(ctx context.Context, b *EventBatch) error {
+	if len(m) == 0 {
+		return nil
+	}
+	if err := sendTo(ctx, m[0], b); err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for _, s := range m[1:] {
+		wg.Add(1)
+		go func(s EventSink) {
+			defer wg.Done()
+			if err := sendTo(ctx, s, b); err != nil {
+				slog.Error("Event sink error - batch dropped for this sink", "sink", s.Name(), "events", len(b.Events), "error", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Close closes all the sinks
+func (m MultiSink) Close() error {
+	var errs []error
+	for _, s := range m {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// IngestSink sends batches to the SparkPost Ingest API
+type IngestSink struct {
+	Host   string
+	APIKey string
+}
+
+// NewIngestSink returns a sink for the SparkPost Ingest API at host
+func NewIngestSink(host, apiKey string) *IngestSink {
+	return &IngestSink{Host: host, APIKey: apiKey}
+}
+
+// Name of the sink
+func (s *IngestSink) Name() string { return SinkSparkPost }
+
+// Send uploads b to the Ingest API
+func (s *IngestSink) Send(ctx context.Context, b *EventBatch) error {
+	return sparkPostIngest(ctx, b.NDJSON, b.MessageIDs(), s.Host, s.APIKey)
+}
+
+// Close does nothing
+func (s *IngestSink) Close() error { return nil }
+
+// StatusError is an http response status other than 2xx
+type StatusError struct {
+	URL    string
+	Status string
+	Code   int
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s returned %s %s", e.URL, e.Status, e.Body)
+}
+
+// post makes req with client, or a default client if nil. The response status and body are returned; any status
+// other than 2xx is a *StatusError.
+func post(client *http.Client, req *http.Request) (string, []byte, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 60 * time.Second}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer res.Body.Close()
+	respBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return res.Status, nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		return res.Status, respBody, &StatusError{URL: req.URL.Redacted(), Status: res.Status, Code: res.StatusCode,
+			Body: strings.TrimSpace(string(respBody))}
+	}
+	return res.Status, respBody, nil
+}
+
+// FileSink appends each batch to a local file as NDJSON, rotating it as it grows
+type FileSink struct {
+	out *lumberjack.Logger
+}
+
+// NewFileSink returns a sink writing to filename, rotated every maxSize megabytes. Rotated files are compressed, and
+// removed after maxAge days, or when there are more than maxBackups of them. Zero keeps them all.
+func NewFileSink(filename string, maxSize, maxBackups, maxAge int) *FileSink {
+	return &FileSink{out: &lumberjack.Logger{
+		Filename:   filename,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+		MaxAge:     maxAge,
+		Compress:   true,
+	}}
+}
+
+// Name of the sink
+func (s *FileSink) Name() string { return SinkFile }
+
+// Send appends b to the file
+func (s *FileSink) Send(ctx context.Context, b *EventBatch) error {
+	ndjson, err := eventsNDJSON(b.Events)
+	if err != nil {
+		return err
+	}
+	_, err = s.out.Write(ndjson)
+	return err
+}
+
+// Close closes the file
+func (s *FileSink) Close() error { return s.out.Close() }
+
+// StdoutSink writes each batch to W as NDJSON
+type StdoutSink struct {
+	W io.Writer
+}
+
+// NewStdoutSink returns a sink writing to the standard output
+func NewStdoutSink() *StdoutSink {
+	return &StdoutSink{W: os.Stdout}
+}
+
+// Name of the sink
+func (s *StdoutSink) Name() string { return SinkStdout }
+
+// Send writes b
+func (s *StdoutSink) Send(ctx context.Context, b *EventBatch) error {
+	ndjson, err := eventsNDJSON(b.Events)
+	if err != nil {
+		return err
+	}
+	_, err = s.W.Write(ndjson)
+	return err
+}
+
+// eventsNDJSON formats events as NDJSON, with all their fields
+func eventsNDJSON(events []SparkPostEvent) ([]byte, error) {
+	var ndjson []byte
+	for _, e := range events {
+		eJSON, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		ndjson = append(append(ndjson, eJSON...), '\n')
+	}
+	return ndjson, nil
+}
+
+// Close does nothing
+func (s *StdoutSink) Close() error { return nil }
+
+// KafkaSink produces each event as a message on a Kafka topic, via a Kafka REST Proxy (API v2).
+// Messages are keyed by message ID, so events for the same message go to the same partition.
+type KafkaSink struct {
+	RESTURL string // base URL of the REST Proxy, e.g. http://localhost:8082
+	Topic   string
+	Client  *http.Client
+}
+
+type kafkaRecord struct {
+	Key   string         `json:"key"`
+	Value SparkPostEvent `json:"value"`
+}
+
+// kafkaResponse is the part of the REST Proxy response we need, to check each record was accepted
+type kafkaResponse struct {
+	Offsets []struct {
+		Partition int     `json:"partition"`
+		Offset    int64   `json:"offset"`
+		Error     *string `json:"error"`
+	} `json:"offsets"`
+}
+
+// Name of the sink
+func (s *KafkaSink) Name() string { return SinkKafka }
+
+// Send produces the events in b to the topic
+func (s *KafkaSink) Send(ctx context.Context, b *EventBatch) error {
+	records := make([]kafkaRecord, len(b.Events))
+	for i, e := range b.Events {
+		records[i] = kafkaRecord{Key: e.EventWrapper.EventGrouping.MessageID, Value: e}
+	}
+	body, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+	u := strings.TrimSuffix(s.RESTURL, "/") + "/topics/" + url.PathEscape(s.Topic)
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	_, respBody, err := post(s.Client, req)
+	if err != nil {
+		return err
+	}
+	var kr kafkaResponse
+	if err = json.Unmarshal(respBody, &kr); err != nil {
+		return err
+	}
+	failed := 0
+	var lastErr string
+	for _, o := range kr.Offsets {
+		if o.Error != nil {
+			failed++
+			lastErr = *o.Error
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("topic %s rejected %d of %d events: %s", s.Topic, failed, len(records), lastErr)
+	}
+	slog.Info("Produced batch to Kafka", "topic", s.Topic, "events", len(records))
+	return nil
+}
+
+// Close does nothing
+func (s *KafkaSink) Close() error { return nil }
+
+// SinkConfig selects the event sinks the feeder sends to, with the settings for each
+type SinkConfig struct {
+	Sinks []string // names of the sinks, e.g. sparkpost, webhook
+
+	IngestHost   string
+	IngestAPIKey string
+
+	WebhookURL        string
+	WebhookFormat     string
+	WebhookAuthHeader string
+	WebhookAuthValue  string
+	WebhookHMACKey    []byte
+	Webhooks          []*WebhookSink // more endpoints, e.g. from LoadWebhooks
+
+	FilePath       string
+	FileMaxSize    int
+	FileMaxBackups int
+	FileMaxAge     int
+
+	KafkaRESTURL string
+	KafkaTopic   string
+
+	ArchiveDir    string
+	ArchiveMaxAge int
+}
+
+// NewEventSink makes the sinks named in c. If there is more than one, they are combined into a MultiSink.
+func NewEventSink(c SinkConfig) (EventSink, error) {
+	var sinks MultiSink
+	seen := make(map[string]bool)
+	for _, name := range c.Sinks {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if seen[name] {
+			return nil, fmt.Errorf("event sink %s given more than once", name)
+		}
+		seen[name] = true
+		var s EventSink
+		switch name {
+		case SinkSparkPost:
+			if c.IngestAPIKey == "" {
+				return nil, errors.New("sparkpost event sink needs an Ingest API key")
+			}
+			s = NewIngestSink(c.IngestHost, c.IngestAPIKey)
+		case SinkWebhook:
+			if c.WebhookURL == "" && len(c.Webhooks) == 0 {
+				return nil, errors.New("webhook event sink needs a URL")
+			}
+			if c.WebhookURL != "" {
+				w, err := NewWebhookSink(WebhookConfig{URL: c.WebhookURL, Format: c.WebhookFormat, AuthHeader: c.WebhookAuthHeader,
+					AuthValue: c.WebhookAuthValue, HMACKey: string(c.WebhookHMACKey)})
+				if err != nil {
+					return nil, err
+				}
+				sinks = append(sinks, w)
+			}
+			for _, w := range c.Webhooks {
+				sinks = append(sinks, w)
+			}
+			continue
+		case SinkFile:
+			if c.FilePath == "" {
+				return nil, errors.New("file event sink needs a filename")
+			}
+			s = NewFileSink(c.FilePath, c.FileMaxSize, c.FileMaxBackups, c.FileMaxAge)
+		case SinkKafka:
+			if c.KafkaRESTURL == "" || c.KafkaTopic == "" {
+				return nil, errors.New("kafka event sink needs a REST Proxy URL and topic")
+			}
+			s = &KafkaSink{RESTURL: c.KafkaRESTURL, Topic: c.KafkaTopic}
+		case SinkStdout:
+			s = NewStdoutSink()
+		case SinkArchive:
+			if c.ArchiveDir == "" {
+				return nil, errors.New("archive event sink needs a directory")
+			}
+			var err error
+			if s, err = NewArchiveSink(c.ArchiveDir, c.ArchiveMaxAge); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown event sink %q", name)
+		}
+		sinks = append(sinks, s)
+	}
+	switch len(sinks) {
+	case 0:
+		return nil, errors.New("no event sinks given")
+	case 1:
+		return sinks[0], nil
+	}
+	return sinks, nil
+}
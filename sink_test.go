@@ -0,0 +1,158 @@
+package sparkypmtatracking_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+// makeBatch returns a batch of n click events
+func makeBatch(t *testing.T, n int) *spmta.EventBatch {
+	var b spmta.EventBatch
+	for i := 0; i < n; i++ {
+		var e spmta.SparkPostEvent
+		g := &e.EventWrapper.EventGrouping
+		g.Type = "click"
+		g.MessageID = spmta.UniqMessageID()
+		g.TargetLinkURL = testURL
+		g.IPAddress = testIPAddress
+		g.UserAgent = testUserAgent
+		eJSON, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Events = append(b.Events, e)
+		b.NDJSON = append(append(b.NDJSON, eJSON...), '\n')
+	}
+	return &b
+}
+
+func TestNewEventSink(t *testing.T) {
+	for _, c := range []spmta.SinkConfig{
+		{},
+		{Sinks: []string{"sparkpost"}},
+		{Sinks: []string{"webhook"}},
+		{Sinks: []string{"file"}},
+		{Sinks: []string{"kafka"}, KafkaRESTURL: "http://localhost:8082"},
+		{Sinks: []string{"stdout", "stdout"}},
+		{Sinks: []string{"carrier_pigeon"}},
+	} {
+		if _, err := spmta.NewEventSink(c); err == nil {
+			t.Errorf("Expected an error from %+v", c)
+		}
+	}
+	s, err := spmta.NewEventSink(spmta.SinkConfig{Sinks: []string{"sparkpost"}, IngestAPIKey: mockAPIKey})
+	if _, ok := s.(*spmta.IngestSink); !ok || err != nil {
+		t.Errorf("Unexpected %T %v", s, err)
+	}
+	s, err = spmta.NewEventSink(spmta.SinkConfig{Sinks: []string{"stdout", " Webhook"}, WebhookURL: "http://localhost/"})
+	if _, ok := s.(spmta.MultiSink); !ok || err != nil || s.Name() != "stdout,webhook" {
+		t.Errorf("Unexpected %T %v", s, err)
+	}
+}
+
+func TestKafkaSink(t *testing.T) {
+	var records struct {
+		Records []struct {
+			Key   string               `json:"key"`
+			Value spmta.SparkPostEvent `json:"value"`
+		} `json:"records"`
+	}
+	reply := `{"offsets":[{"partition":0,"offset":1},{"partition":0,"offset":2}]}`
+	mock := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics/events" || r.Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(reply))
+	}))
+	defer mock.Close()
+
+	b := makeBatch(t, 2)
+	s := &spmta.KafkaSink{RESTURL: mock.URL + "/", Topic: "events"}
+	if err := s.Send(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	if len(records.Records) != 2 || records.Records[1].Key != b.Events[1].EventWrapper.EventGrouping.MessageID ||
+		records.Records[1].Value.EventWrapper.EventGrouping.IPAddress != testIPAddress {
+		t.Errorf("Unexpected records %+v", records)
+	}
+
+	// Records the proxy could not produce are errors
+	reply = `{"offsets":[{"partition":0,"offset":3},{"error_code":50002,"error":"Kafka error"}]}`
+	if err := s.Send(context.Background(), b); err == nil || !strings.Contains(err.Error(), "rejected 1 of 2 events: Kafka error") {
+		t.Errorf("Expected an error, got %v", err)
+	}
+	s.Topic = "nonexistent"
+	if err := s.Send(context.Background(), b); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "events.ndjson")
+	s := spmta.NewFileSink(filename, 1, 0, 0)
+	b1, b2 := makeBatch(t, 2), makeBatch(t, 3)
+	for _, b := range []*spmta.EventBatch{b1, b2} {
+		if err := s.Send(context.Background(), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, append(b1.NDJSON, b2.NDJSON...)) {
+		t.Errorf("Unexpected file content %s", content)
+	}
+}
+
+// A failing main sink fails the batch, before the others are sent it. A failing other sink does not stop the rest.
+func TestMultiSink(t *testing.T) {
+	mock := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer mock.Close()
+	var out bytes.Buffer
+	failuresBefore := testutil.ToFloat64(spmta.FeedSinkFailures.WithLabelValues("webhook"))
+
+	b := makeBatch(t, 2)
+	m := spmta.MultiSink{&spmta.WebhookSink{URL: mock.URL}, &spmta.StdoutSink{W: &out}}
+	err := m.Send(context.Background(), b)
+	if err == nil || !strings.HasPrefix(err.Error(), "webhook: ") {
+		t.Errorf("Expected webhook error, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Batch sent to the other sinks after the main sink failed: %s", out.String())
+	}
+
+	m = spmta.MultiSink{&spmta.StdoutSink{W: &out}, &spmta.WebhookSink{URL: mock.URL}}
+	if err = m.Send(context.Background(), b); err != nil {
+		t.Errorf("Failing other sink failed the batch: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), b.NDJSON) {
+		t.Errorf("Unexpected output %s", out.String())
+	}
+	if got := testutil.ToFloat64(spmta.FeedSinkFailures.WithLabelValues("webhook")) - failuresBefore; got != 2 {
+		t.Errorf("Expected 2 webhook failures counted, got %v", got)
+	}
+	if err = m.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,337 @@
+package sparkypmtatracking
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+)
+
+// RedisStream connects the tracker to a consumer group of feeders, as an alternative to RedisQueue
+const RedisStream = "trk_stream"
+
+// FeederGroup is the Redis consumer group that feeders read RedisStream in
+const FeederGroup = "feeder"
+
+// streamField is the field of each RedisStream entry holding the event
+const streamField = "event"
+
+// FeedDefaultClaimAfter is how long an event can be pending for one feeder before another claims it
+const FeedDefaultClaimAfter = 5 * time.Minute
+
+// streamReadCount is the most entries read from the stream at once
+const streamReadCount = 100
+
+// claimMaxPages is the most pages of pending entries read by one claim, looking for entries to claim
+const claimMaxPages = 10
+
+// eventSource is where the feeder takes events from
+type eventSource interface {
+	// next returns the next event and its ID, waiting up to wait for one. Returns redis.Nil if there is none.
+	next(wait time.Duration) (id string, event string, err error)
+	// done acknowledges events that have been sent, or dropped, so they are not taken again
+	done(ids ...string) error
+	// retry puts back events that were taken but not sent, so they are taken again, with the same IDs
+	retry(ids, events []string) error
+	// depth returns the number of events waiting, including those taken but not yet acknowledged
+	depth() (int64, error)
+	// consumers returns the state of each feeder reading the source, if they are tracked
+	consumers() ([]StreamConsumer, error)
+}
+
+// listSource pops events from RedisQueue. List entries have no IDs of their own, so each is given one when taken.
+// Events are gone from the queue once taken, so there is nothing to acknowledge; events that could not be sent are
+// put on RedisRetryQueue with their IDs, and taken from there first.
+type listSource struct {
+	client  *redis.Client
+	mu      sync.Mutex
+	retries bool // RedisRetryQueue may hold events, so look there before RedisQueue
+}
+
+// retryEntry is an event on RedisRetryQueue
+type retryEntry struct {
+	ID    string `json:"id"`
+	Event string `json:"event"`
+}
+
+func (s *listSource) next(wait time.Duration) (string, string, error) {
+	if wait < time.Second {
+		// BLPOP can't wait for less than a second, so wait, then just look
+		time.Sleep(wait)
+		id, ev, err := s.popRetry()
+		if err != redis.Nil {
+			return id, ev, err
+		}
+		if ev, err = s.client.LPop(RedisQueue).Result(); err != nil {
+			return "", "", err
+		}
+		return s.entry(RedisQueue, ev)
+	}
+	kv, err := s.client.BLPop(wait.Truncate(time.Second), RedisRetryQueue, RedisQueue).Result() // BLPOP waits for whole seconds
+	if err != nil {
+		return "", "", err
+	}
+	return s.entry(kv[0], kv[1])
+}
+
+// popRetry takes the next event from RedisRetryQueue, if it may hold any. Returns redis.Nil if there is none.
+func (s *listSource) popRetry() (string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.retries {
+		return "", "", redis.Nil
+	}
+	ev, err := s.client.LPop(RedisRetryQueue).Result()
+	if err == redis.Nil {
+		s.retries = false
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return s.entry(RedisRetryQueue, ev)
+}
+
+// entry returns the ID and event of an entry taken from queue q
+func (s *listSource) entry(q, ev string) (string, string, error) {
+	if q != RedisRetryQueue {
+		return uuid.New().String(), ev, nil
+	}
+	var r retryEntry
+	if err := json.Unmarshal([]byte(ev), &r); err != nil {
+		return "", "", err
+	}
+	return r.ID, r.Event, nil
+}
+
+func (s *listSource) done(ids ...string) error {
+	return nil
+}
+
+func (s *listSource) retry(ids, events []string) error {
+	if len(events) == 0 {
+		return nil
+	}
+	entries := make([]interface{}, len(events))
+	for i := range events {
+		b, err := json.Marshal(retryEntry{ID: ids[i], Event: events[i]})
+		if err != nil {
+			return err
+		}
+		entries[len(events)-1-i] = b // LPUSH reverses them, so they are taken again in order
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retries = true
+	return s.client.LPush(RedisRetryQueue, entries...).Err()
+}
+
+func (s *listSource) depth() (int64, error) {
+	pipe := s.client.Pipeline()
+	retries := pipe.LLen(RedisRetryQueue)
+	queued := pipe.LLen(RedisQueue)
+	if _, err := pipe.Exec(); err != nil {
+		return 0, err
+	}
+	return retries.Val() + queued.Val(), nil
+}
+
+func (s *listSource) consumers() ([]StreamConsumer, error) {
+	return nil, nil
+}
+
+// streamSource reads events from RedisStream as one consumer in FeederGroup. Entries stay pending for the consumer
+// until acknowledged; entries left pending by another consumer for claimAfter are claimed by this one.
+type streamSource struct {
+	client     *redis.Client
+	consumer   string
+	claimAfter time.Duration
+	backlog    []redis.XMessage // entries read, not yet taken
+	lastClaim  time.Time
+	claimFrom  string // pending entry ID the next claim reads from, or "" to start at the beginning
+}
+
+// createGroup creates FeederGroup, and RedisStream, if they don't exist yet
+func (s *streamSource) createGroup() error {
+	err := s.client.XGroupCreateMkStream(RedisStream, FeederGroup, "0").Err()
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil // already exists
+	}
+	return err
+}
+
+// nextStreamID returns the lowest stream entry ID after id
+func nextStreamID(id string) string {
+	ms, seq, _ := strings.Cut(id, "-")
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return id
+	}
+	return ms + "-" + strconv.FormatUint(n+1, 10)
+}
+
+func (s *streamSource) next(wait time.Duration) (string, string, error) {
+	// Carry on claiming straight away if the last claim did not get to the end of the pending entries
+	if len(s.backlog) == 0 && (s.claimFrom != "" || time.Since(s.lastClaim) >= s.claimAfter/2) {
+		if err := s.claim(); err != nil {
+			return "", "", err
+		}
+	}
+	if len(s.backlog) == 0 {
+		args := &redis.XReadGroupArgs{
+			Group:    FeederGroup,
+			Consumer: s.consumer,
+			Streams:  []string{RedisStream, ">"},
+			Count:    streamReadCount,
+			Block:    wait,
+		}
+		if wait < time.Millisecond {
+			args.Block = -1 // BLOCK 0 would wait forever, so just look
+		}
+		streams, err := s.client.XReadGroup(args).Result()
+		if err != nil {
+			return "", "", err
+		}
+		for _, st := range streams {
+			s.backlog = append(s.backlog, st.Messages...)
+		}
+		if len(s.backlog) == 0 {
+			return "", "", redis.Nil
+		}
+	}
+	m := s.backlog[0]
+	s.backlog = s.backlog[1:]
+	ev, _ := m.Values[streamField].(string)
+	return m.ID, ev, nil
+}
+
+// claim takes over entries that have been pending for claimAfter, e.g. because the consumer that read them has
+// stopped, or could not send them. Pending entries are read a page at a time, carrying on from where the last claim
+// got to, until some can be claimed or the end is reached.
+func (s *streamSource) claim() error {
+	s.lastClaim = time.Now()
+	start := s.claimFrom
+	if start == "" {
+		start = "-"
+	}
+	var ids []string
+	from := make(map[string]int)
+	for page := 0; len(ids) == 0 && page < claimMaxPages; page++ {
+		pending, err := s.client.XPendingExt(&redis.XPendingExtArgs{
+			Stream: RedisStream,
+			Group:  FeederGroup,
+			Start:  start,
+			End:    "+",
+			Count:  streamReadCount,
+		}).Result()
+		if err != nil {
+			return err
+		}
+		for _, p := range pending {
+			if p.Idle >= s.claimAfter {
+				ids = append(ids, p.Id)
+				from[p.Consumer]++
+			}
+		}
+		if len(pending) < streamReadCount {
+			start = "" // the end, so the next claim starts at the beginning again
+			break
+		}
+		start = nextStreamID(pending[len(pending)-1].Id)
+	}
+	s.claimFrom = start
+	if len(ids) == 0 {
+		return nil
+	}
+	msgs, err := s.client.XClaim(&redis.XClaimArgs{
+		Stream:   RedisStream,
+		Group:    FeederGroup,
+		Consumer: s.consumer,
+		MinIdle:  s.claimAfter, // another consumer may have claimed them since
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	if len(msgs) > 0 {
+		slog.Info("Claimed pending events", "consumer", s.consumer, "events", len(msgs), "from", from)
+		FeedClaimed.Add(float64(len(msgs)))
+		s.backlog = append(s.backlog, msgs...)
+	}
+	return nil
+}
+
+// done acknowledges the entries and deletes them, so the stream holds only events not yet sent
+func (s *streamSource) done(ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	pipe := s.client.TxPipeline()
+	pipe.XAck(RedisStream, FeederGroup, ids...)
+	pipe.XDel(RedisStream, ids...)
+	_, err := pipe.Exec()
+	return err
+}
+
+// retry does nothing, as entries not acknowledged stay pending, to be claimed
+func (s *streamSource) retry(ids, events []string) error {
+	return nil
+}
+
+func (s *streamSource) depth() (int64, error) {
+	return s.client.XLen(RedisStream).Result()
+}
+
+func (s *streamSource) consumers() ([]StreamConsumer, error) {
+	return FeederConsumers(s.client)
+}
+
+// StreamConsumer is the state of one feeder in FeederGroup
+type StreamConsumer struct {
+	Name    string
+	Pending int64         // events taken, not yet sent
+	Idle    time.Duration // time since the consumer last read the stream
+}
+
+// FeederConsumers returns the feeders in FeederGroup, ordered by name
+func FeederConsumers(client *redis.Client) ([]StreamConsumer, error) {
+	cs := []StreamConsumer{}
+	res, err := client.Do("XINFO", "CONSUMERS", RedisStream, FeederGroup).Result()
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "NOGROUP") || strings.Contains(err.Error(), "no such key") {
+			return cs, nil // no feeder has started yet
+		}
+		return nil, err
+	}
+	list, ok := res.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected XINFO CONSUMERS reply %v", res)
+	}
+	for _, item := range list {
+		fields, ok := item.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected XINFO CONSUMERS entry %v", item)
+		}
+		var c StreamConsumer
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch k, _ := fields[i].(string); k {
+			case "name":
+				c.Name, _ = fields[i+1].(string)
+			case "pending":
+				c.Pending, _ = fields[i+1].(int64)
+			case "idle":
+				ms, _ := fields[i+1].(int64)
+				c.Idle = time.Duration(ms) * time.Millisecond
+			}
+		}
+		cs = append(cs, c)
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Name < cs[j].Name })
+	return cs, nil
+}
@@ -0,0 +1,225 @@
+package sparkypmtatracking_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+// emptyRedisStream removes the stream, and with it the feeder consumer group
+func emptyRedisStream(t *testing.T, client *redis.Client) {
+	if err := client.Del(spmta.RedisStream).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mockStreamEvents adds nEvents to the stream, as the tracker does with Stream set
+func mockStreamEvents(t *testing.T, nEvents int, client *redis.Client) {
+	for i := 0; i < nEvents; i++ {
+		eBytes, err := json.Marshal(testEvent(spmta.UniqMessageID()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = client.XAdd(&redis.XAddArgs{Stream: spmta.RedisStream, Values: map[string]interface{}{"event": eBytes}}).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// failSink rejects every batch
+type failSink struct{}
+
+func (failSink) Name() string { return "fail" }
+
+func (failSink) Send(ctx context.Context, b *spmta.EventBatch) error {
+	return errors.New("sink unavailable")
+}
+
+func (failSink) Close() error { return nil }
+
+func TestTrackerStream(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisQueue(client)
+	emptyRedisStream(t, client)
+	tracker := spmta.NewTracker(nil)
+	tracker.Stream = true
+	link, err := spmta.EncodeLink(RandomBaseURL(), "open", spmta.UniqMessageID(), RandomRecipient(), "", true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	tracker.ServeHTTP(rr, httptest.NewRequest("GET", link, nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Unexpected status %d", rr.Code)
+	}
+	msgs, err := client.XRange(spmta.RedisStream, "-", "+").Result()
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Expected one stream entry, got %v %v", msgs, err)
+	}
+	var e spmta.TrackEvent
+	if err = json.Unmarshal([]byte(msgs[0].Values["event"].(string)), &e); err != nil || e.WD.Action != "o" {
+		t.Errorf("Unexpected stream entry %v %v", msgs[0].Values, err)
+	}
+	if n := client.LLen(spmta.RedisQueue).Val(); n != 0 {
+		t.Errorf("Expected nothing on the queue, got %d", n)
+	}
+}
+
+func TestFeederStream(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisStream(t, client)
+	mockStreamEvents(t, 5, client)
+	var sink batchSink
+	f := spmta.Feeder{Client: client, Sink: &sink, Consumer: "feeder-1", MaxEvents: 2}
+	if err := f.FeedEvents(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(sink.sizes); got != "[2 2 1]" {
+		t.Errorf("Got batches %s", got)
+	}
+	// Sent events are acknowledged, and removed from the stream
+	if n := client.XLen(spmta.RedisStream).Val(); n != 0 {
+		t.Errorf("Expected empty stream, got %d entries", n)
+	}
+	cs, err := spmta.FeederConsumers(client)
+	if err != nil || len(cs) != 1 || cs[0].Name != "feeder-1" || cs[0].Pending != 0 {
+		t.Errorf("Unexpected consumers %+v %v", cs, err)
+	}
+	if v := testutil.ToFloat64(spmta.FeedConsumerPending.WithLabelValues("feeder-1")); v != 0 {
+		t.Errorf("Expected no events pending, got %v", v)
+	}
+	details, err := f.Ready()()
+	if err != nil || details["queue_length"] != int64(0) || details["consumers"] == nil {
+		t.Errorf("Unexpected readiness %v %v", details, err)
+	}
+}
+
+// Events taken by a feeder that can't send them are claimed by another, once they have been pending long enough
+func TestFeederStreamClaim(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisStream(t, client)
+	mockStreamEvents(t, 3, client)
+	const claimAfter = 500 * time.Millisecond
+
+	dead := spmta.Feeder{Client: client, Sink: failSink{}, Consumer: "feeder-dead", ClaimAfter: claimAfter}
+	if err := dead.FeedEvents(context.Background()); err == nil {
+		t.Fatal("Expected sink error")
+	}
+	pending, err := client.XPending(spmta.RedisStream, spmta.FeederGroup).Result()
+	if err != nil || pending.Count != 3 || pending.Consumers["feeder-dead"] != 3 {
+		t.Fatalf("Expected 3 events pending for feeder-dead, got %+v %v", pending, err)
+	}
+
+	// Not yet pending long enough to claim
+	var sink batchSink
+	alive := spmta.Feeder{Client: client, Sink: &sink, Consumer: "feeder-alive", ClaimAfter: claimAfter, PollInterval: 50 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = alive.FeedEvents(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.sizes) != 0 {
+		t.Errorf("Events claimed too soon: %v", sink.sizes)
+	}
+
+	time.Sleep(claimAfter)
+	before := testutil.ToFloat64(spmta.FeedClaimed)
+	alive = spmta.Feeder{Client: client, Sink: &sink, Consumer: "feeder-alive", ClaimAfter: claimAfter}
+	if err = alive.FeedEvents(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(sink.sizes); got != "[3]" {
+		t.Errorf("Got batches %s", got)
+	}
+	if claimed := testutil.ToFloat64(spmta.FeedClaimed) - before; claimed != 3 {
+		t.Errorf("Expected 3 events claimed, got %v", claimed)
+	}
+	if n := client.XLen(spmta.RedisStream).Val(); n != 0 {
+		t.Errorf("Expected empty stream, got %d entries", n)
+	}
+	cs, err := spmta.FeederConsumers(client)
+	if err != nil || len(cs) != 2 || fmt.Sprintf("%s %d %s %d", cs[0].Name, cs[0].Pending, cs[1].Name, cs[1].Pending) != "feeder-alive 0 feeder-dead 0" {
+		t.Errorf("Unexpected consumers %+v %v", cs, err)
+	}
+}
+
+// More events pending than are read at once are all claimed
+func TestFeederStreamClaimMany(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisStream(t, client)
+	const nEvents = 250
+	mockStreamEvents(t, nEvents, client)
+	if err := client.XGroupCreateMkStream(spmta.RedisStream, spmta.FeederGroup, "0").Err(); err != nil {
+		t.Fatal(err)
+	}
+	// Read by a feeder that then stopped
+	if err := client.XReadGroup(&redis.XReadGroupArgs{Group: spmta.FeederGroup, Consumer: "feeder-dead",
+		Streams: []string{spmta.RedisStream, ">"}, Count: nEvents, Block: -1}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	const claimAfter = 100 * time.Millisecond
+	time.Sleep(claimAfter)
+	var sink batchSink
+	alive := spmta.Feeder{Client: client, Sink: &sink, Consumer: "feeder-alive", ClaimAfter: claimAfter}
+	if err := alive.FeedEvents(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sent := 0
+	for _, n := range sink.sizes {
+		sent += n
+	}
+	if sent != nEvents {
+		t.Errorf("Expected %d events claimed and sent, got %d", nEvents, sent)
+	}
+	if n := client.XLen(spmta.RedisStream).Val(); n != 0 {
+		t.Errorf("Expected empty stream, got %d entries", n)
+	}
+}
+
+// An event that isn't valid JSON is dropped; one that fails for another reason, e.g. a Redis error, stays pending
+func TestFeederStreamErrors(t *testing.T) {
+	client := spmta.MyRedis()
+	emptyRedisStream(t, client)
+	if err := client.XAdd(&redis.XAddArgs{Stream: spmta.RedisStream, Values: map[string]interface{}{"event": `{"WD":{"act":"c`}}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	mockStreamEvents(t, 2, client)
+	var sink batchSink
+	f := spmta.Feeder{Client: client, Sink: &sink, Consumer: "feeder-1"}
+	if err := f.FeedEvents(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if n := client.XLen(spmta.RedisStream).Val(); n != 0 {
+		t.Errorf("Expected invalid event dropped, got %d entries", n)
+	}
+	if got := fmt.Sprint(sink.sizes); got != "[2]" {
+		t.Errorf("Expected the valid events sent, got batches %s", got)
+	}
+
+	msgID := spmta.UniqMessageID()
+	client.HSet(spmta.TrackingPrefix+msgID, "rcpt", "bob@example.com") // GET fails with WRONGTYPE
+	defer client.Del(spmta.TrackingPrefix + msgID)
+	eBytes, err := json.Marshal(testEvent(msgID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.XAdd(&redis.XAddArgs{Stream: spmta.RedisStream, Values: map[string]interface{}{"event": eBytes}}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.FeedEvents(context.Background()); err == nil || !wrongTypeErr(err) {
+		t.Errorf("Expected WRONGTYPE error, got %v", err)
+	}
+	pending, err := client.XPending(spmta.RedisStream, spmta.FeederGroup).Result()
+	if err != nil || pending.Count != 1 || client.XLen(spmta.RedisStream).Val() != 1 {
+		t.Errorf("Expected the event pending, got %+v %v", pending, err)
+	}
+}
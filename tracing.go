@@ -0,0 +1,51 @@
+package sparkypmtatracking
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer makes the spans for all the services. Until SetupTracing is called, spans are not recorded.
+var tracer = otel.Tracer("github.com/tuck1s/sparkypmtatracking")
+
+// MessageIDAttr is the span attribute carrying the message ID, so one message can be followed from the wrapper,
+// through acct_etl and the tracker, to the feeder
+const MessageIDAttr = attribute.Key("message_id")
+
+// SetupTracing sends spans for service to the OTLP/HTTP collector at endpoint, e.g. http://localhost:4318.
+// If endpoint is blank, tracing stays off. The returned function flushes any spans not yet sent, and should be
+// called before exiting.
+func SetupTracing(service string, endpoint string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// endSpan records err, if any, on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
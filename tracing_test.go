@@ -0,0 +1,181 @@
+package sparkypmtatracking_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	smtpproxy "github.com/tuck1s/go-smtpproxy"
+	spmta "github.com/tuck1s/sparkypmtatracking"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spanExporter    = tracetest.NewInMemoryExporter()
+	tracingOnce     sync.Once
+	testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+)
+
+// recordSpans sends spans to an in-memory exporter, which is emptied for each test.
+// The global provider can only be set once for the package tracer to pick up, so it is shared by all tests.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	tracingOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spanExporter)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	spanExporter.Reset()
+	return spanExporter
+}
+
+// findSpan returns the first recorded span called name
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	for _, s := range spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("No span %s in %d spans", name, len(spans))
+	return tracetest.SpanStub{}
+}
+
+// spanAttr returns the value of attribute key on span s, as a string
+func spanAttr(s tracetest.SpanStub, key string) string {
+	for _, a := range s.Attributes {
+		if string(a.Key) == key {
+			return a.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestSetupTracing(t *testing.T) {
+	shutdown, err := spmta.SetupTracing("test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+// Rejected requests are recorded as failed spans, continuing the trace of the proxy in front
+func TestTrackerTracing(t *testing.T) {
+	exp := recordSpans(t)
+	tracker := spmta.NewTracker(&spmta.TrackerConfig{})
+	req := httptest.NewRequest("GET", "http://unknown.example.com/abc", nil)
+	req.Header.Set("traceparent", testTraceParent)
+	rr := httptest.NewRecorder()
+	tracker.ServeHTTP(rr, req)
+	if rr.Code != http.StatusMisdirectedRequest {
+		t.Errorf("Unexpected status %d", rr.Code)
+	}
+	s := findSpan(t, exp.GetSpans(), "tracker.request")
+	if s.Status.Code != codes.Error || spanAttr(s, "http.host") != "unknown.example.com" {
+		t.Errorf("Unexpected span %+v", s)
+	}
+	if s.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Span is not part of the incoming trace: %s", s.SpanContext.TraceID())
+	}
+}
+
+func TestSparkPostIngestTracing(t *testing.T) {
+	exp := recordSpans(t)
+	mockIngest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != mockAPIKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errors": [ {"message": "Unauthorized."} ]}`))
+			return
+		}
+		w.Write([]byte(`{"results": {"id": "` + testMockBatchResponse + `"} }`))
+	}))
+	defer mockIngest.Close()
+	if err := spmta.SparkPostIngest([]byte("{}\n"), nil, mockIngest.URL, mockAPIKey); err != nil {
+		t.Fatal(err)
+	}
+	s := findSpan(t, exp.GetSpans(), "SparkPostIngest")
+	if s.Status.Code == codes.Error || spanAttr(s, "ingest.batch_id") != testMockBatchResponse || spanAttr(s, "http.response.status_code") != "200" {
+		t.Errorf("Unexpected span %+v", s)
+	}
+
+	// Failed uploads are recorded as errors
+	exp.Reset()
+	if err := spmta.SparkPostIngest([]byte("{}\n"), nil, mockIngest.URL, "wrong key"); err == nil {
+		t.Error("Expected an error")
+	}
+	if s = findSpan(t, exp.GetSpans(), "SparkPostIngest"); s.Status.Code != codes.Error || spanAttr(s, "http.response.status_code") != "401" {
+		t.Errorf("Unexpected span %+v", s)
+	}
+}
+
+// fakeUpstream accepts one SMTP connection, and replies to each command with the code for it
+func fakeUpstream(t *testing.T, replies map[string]string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			verb := strings.ToUpper(strings.Fields(line + " x")[0])
+			reply, ok := replies[verb]
+			if !ok {
+				reply = "500 unknown command"
+			}
+			c.Write([]byte(reply + "\r\n"))
+		}
+	}()
+	return l.Addr().String()
+}
+
+// Each command is a child span of the session, which ends at QUIT
+func TestWrapperTracing(t *testing.T) {
+	exp := recordSpans(t)
+	addr := fakeUpstream(t, map[string]string{"MAIL": "250 OK", "RCPT": "550 no such user", "QUIT": "221 bye"})
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := spmta.NewBackend(addr, false, nil, nil, true)
+	s := spmta.MakeSession(&smtpproxy.Client{Text: c}, be)
+	if _, _, err = s.Mail(250, "MAIL", "FROM:<a@example.com>"); err != nil {
+		t.Error(err)
+	}
+	if _, _, err = s.Rcpt(250, "RCPT", "TO:<b@example.com>"); err == nil {
+		t.Error("Expected an error")
+	}
+	if _, _, err = s.Quit(221, "QUIT", ""); err != nil {
+		t.Error(err)
+	}
+
+	spans := exp.GetSpans()
+	session := findSpan(t, spans, "smtp.session")
+	for name, code := range map[string]string{"smtp MAIL": "250", "smtp RCPT": "550", "smtp QUIT": "221"} {
+		cmd := findSpan(t, spans, name)
+		if cmd.Parent.SpanID() != session.SpanContext.SpanID() || spanAttr(cmd, "smtp.code") != code {
+			t.Errorf("Unexpected span %+v", cmd)
+		}
+	}
+	if findSpan(t, spans, "smtp RCPT").Status.Code != codes.Error {
+		t.Error("Expected RCPT span to be an error")
+	}
+}
@@ -0,0 +1,161 @@
+package sparkypmtatracking
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// TrackingHost holds the settings for one tracking domain served by the tracker
+type TrackingHost struct {
+	SigningKey             string   `json:"signing_key"`              // If set, links must carry a valid signature made with this key
+	AllowedRedirectSchemes []string `json:"allowed_redirect_schemes"` // Target URL schemes allowed. Default is http, https and mailto
+	AllowedRedirectDomains []string `json:"allowed_redirect_domains"` // If set, clicks to other domains get the "you are leaving" page
+	DeniedRedirectDomains  []string `json:"denied_redirect_domains"`  // Clicks to these domains (and their subdomains) are never redirected
+	FallbackURL            string   `json:"fallback_url"`             // Where to send clicks that can't go to their target
+	CertFile               string   `json:"certfile"`                 // Optional TLS certificate for this domain, chosen by SNI
+	PrivKeyFile            string   `json:"privkeyfile"`
+	cert                   *tls.Certificate
+}
+
+// TrackerConfig maps tracking domain names to their settings. Requests for other hosts are rejected.
+type TrackerConfig struct {
+	Hosts map[string]*TrackingHost `json:"hosts"`
+}
+
+// LoadTrackerConfig reads a JSON tracker config file
+func LoadTrackerConfig(filename string) (*TrackerConfig, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadTrackerConfig(f)
+}
+
+// ReadTrackerConfig reads JSON tracker config from r, checks it, and loads any certificates
+func ReadTrackerConfig(r io.Reader) (*TrackerConfig, error) {
+	var c TrackerConfig
+	if err := json.NewDecoder(r).Decode(&c); err != nil {
+		return nil, err
+	}
+	if len(c.Hosts) == 0 {
+		return nil, errors.New("Tracker config has no hosts")
+	}
+	hosts := make(map[string]*TrackingHost, len(c.Hosts))
+	for name, h := range c.Hosts {
+		if h == nil {
+			h = &TrackingHost{}
+		}
+		if h.FallbackURL != "" {
+			if _, err := url.ParseRequestURI(h.FallbackURL); err != nil {
+				return nil, fmt.Errorf("Host %s fallback_url: %v", name, err)
+			}
+		}
+		if h.CertFile != "" || h.PrivKeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(h.CertFile, h.PrivKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("Host %s: %v", name, err)
+			}
+			h.cert = &cert
+		}
+		hosts[strings.ToLower(name)] = h
+	}
+	c.Hosts = hosts
+	return &c, nil
+}
+
+// Host returns the settings for the host part of hostPort (as found in an http request), or nil if not configured
+func (c *TrackerConfig) Host(hostPort string) *TrackingHost {
+	host := hostPort
+	if h, _, err := net.SplitHostPort(hostPort); err == nil {
+		host = h
+	}
+	return c.Hosts[strings.ToLower(host)]
+}
+
+// GetCertificate chooses the TLS certificate for the requested server name (SNI), for use in tls.Config.
+// Returns nil certificate (so other certificates in the tls.Config are tried) if the host has none.
+func (c *TrackerConfig) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if h := c.Host(hello.ServerName); h != nil {
+		return h.cert, nil
+	}
+	return nil, nil
+}
+
+// HasCertificates returns true if any host has its own TLS certificate
+func (c *TrackerConfig) HasCertificates() bool {
+	for _, h := range c.Hosts {
+		if h.cert != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// RedirectVerdict says how the tracker should respond to a click
+type RedirectVerdict int
+
+// Redirect verdicts
+const (
+	RedirectOK      RedirectVerdict = iota // redirect to the target
+	RedirectConfirm                        // show the "you are leaving" page, so the user can choose to continue
+	RedirectBlocked                        // don't send the user to the target
+)
+
+// defaultRedirectSchemes are allowed when a host has no allowed_redirect_schemes set
+var defaultRedirectSchemes = []string{"http", "https", "mailto"}
+
+// CheckRedirect returns the verdict on a click to target, and the reason if not RedirectOK.
+// The deny list and schemes are checked first, then the allow list. A nil host has the default schemes and no domain lists.
+func (h *TrackingHost) CheckRedirect(target string) (RedirectVerdict, string) {
+	var settings TrackingHost
+	if h != nil {
+		settings = *h
+	}
+	if len(settings.AllowedRedirectSchemes) == 0 {
+		settings.AllowedRedirectSchemes = defaultRedirectSchemes
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return RedirectBlocked, "invalid_url"
+	}
+	if !stringInList(u.Scheme, settings.AllowedRedirectSchemes) {
+		return RedirectBlocked, "scheme"
+	}
+	if domainInList(u.Hostname(), settings.DeniedRedirectDomains) {
+		return RedirectBlocked, "denied_domain"
+	}
+	if len(settings.AllowedRedirectDomains) > 0 && !domainInList(u.Hostname(), settings.AllowedRedirectDomains) {
+		return RedirectConfirm, "not_allowed_domain"
+	}
+	return RedirectOK, ""
+}
+
+// stringInList returns true if s is in the list, ignoring case
+func stringInList(s string, list []string) bool {
+	for _, l := range list {
+		if strings.EqualFold(s, l) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainInList returns true if host is one of the domains, or a subdomain of one
+func domainInList(host string, domains []string) bool {
+	host = strings.ToLower(host)
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "*."))
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
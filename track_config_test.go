@@ -0,0 +1,111 @@
+package sparkypmtatracking_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+func TestReadTrackerConfig(t *testing.T) {
+	cfg, err := spmta.ReadTrackerConfig(strings.NewReader(testTrackerConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host("track.brand-one.example.com") == nil || cfg.Host("TRACK.brand-one.example.com:443") == nil || cfg.Host("track.brand-two.example.com") == nil {
+		t.Errorf("Configured host not found")
+	}
+	if cfg.Host("track.example.com") != nil {
+		t.Errorf("Unconfigured host found")
+	}
+	if cfg.HasCertificates() {
+		t.Errorf("Config should have no certificates")
+	}
+
+	eList := [][]string{
+		{"unexpected EOF", `{"hosts": {`},
+		{"no hosts", `{"hosts": {}}`},
+		{"fallback_url", `{"hosts": {"a.example.com": {"fallback_url": "not a url"}}}`},
+		{"no such file", `{"hosts": {"a.example.com": {"certfile": "no_such_file.pem", "privkeyfile": "no_such_file.pem"}}}`},
+	}
+	for _, e := range eList {
+		_, err := spmta.ReadTrackerConfig(strings.NewReader(e[1]))
+		if err == nil || !strings.Contains(err.Error(), e[0]) {
+			t.Errorf("Expected error containing %q, got %v", e[0], err)
+		}
+	}
+	if _, err = spmta.LoadTrackerConfig("this_file_does_not_exist.json"); err == nil {
+		t.Errorf("Expected error loading nonexistent file")
+	}
+}
+
+func TestTrackerConfigGetCertificate(t *testing.T) {
+	certName := writeTempFile(t, string(localhostCert))
+	defer os.Remove(certName)
+	keyName := writeTempFile(t, string(localhostKey))
+	defer os.Remove(keyName)
+	cfgJSON := fmt.Sprintf(`{"hosts": {"test.example.com": {"certfile": %q, "privkeyfile": %q}, "other.example.com": {}}}`, certName, keyName)
+	cfg, err := spmta.ReadTrackerConfig(strings.NewReader(cfgJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.HasCertificates() {
+		t.Errorf("Config should have certificates")
+	}
+	for _, c := range []struct {
+		serverName string
+		found      bool
+	}{
+		{"test.example.com", true},
+		{"other.example.com", false},
+		{"unknown.example.com", false},
+	} {
+		cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: c.serverName})
+		if err != nil || (cert != nil) != c.found {
+			t.Errorf("GetCertificate(%s) returned %v, %v", c.serverName, cert, err)
+		}
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	h := spmta.TrackingHost{
+		AllowedRedirectDomains: []string{"example.com", "*.brand.example.org"},
+		DeniedRedirectDomains:  []string{"bad.example.com"},
+	}
+	cases := map[string]spmta.RedirectVerdict{
+		"https://example.com/page":             spmta.RedirectOK,
+		"https://www.EXAMPLE.com/page":         spmta.RedirectOK,
+		"HTTP://example.com/page":              spmta.RedirectOK,
+		"mailto:bob@example.com":               spmta.RedirectConfirm,
+		"https://notexample.com/":              spmta.RedirectConfirm,
+		"https://shop.brand.example.org/":      spmta.RedirectOK,
+		"https://example.org/":                 spmta.RedirectConfirm,
+		"https://example.com.evil.example.net": spmta.RedirectConfirm,
+		"https://bad.example.com/":             spmta.RedirectBlocked,
+		"https://www.bad.example.com/":         spmta.RedirectBlocked,
+		"javascript:alert(1)":                  spmta.RedirectBlocked,
+		"data:text/html,hello":                 spmta.RedirectBlocked,
+		"%%%":                                  spmta.RedirectBlocked,
+	}
+	for target, expected := range cases {
+		if got, reason := h.CheckRedirect(target); got != expected {
+			t.Errorf("CheckRedirect(%s) = %v (%s), expected %v", target, got, reason, expected)
+		}
+	}
+	// Schemes can be set per host
+	ftp := spmta.TrackingHost{AllowedRedirectSchemes: []string{"ftp"}}
+	if got, reason := ftp.CheckRedirect("https://example.com/"); got != spmta.RedirectBlocked || reason != "scheme" {
+		t.Errorf("Expected scheme to be blocked, got %v %s", got, reason)
+	}
+	// No host means only default schemes are checked
+	var open *spmta.TrackingHost
+	if got, _ := open.CheckRedirect("https://anywhere.example.net/"); got != spmta.RedirectOK {
+		t.Errorf("Expected redirect to be allowed")
+	}
+	if got, _ := open.CheckRedirect("javascript:alert(1)"); got != spmta.RedirectBlocked {
+		t.Errorf("Expected redirect to be blocked")
+	}
+}
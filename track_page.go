@@ -0,0 +1,82 @@
+package sparkypmtatracking
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// pageStyle is shared by the pages the tracker serves to people
+const pageStyle = `<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; background: #f4f5f7; color: #222; margin: 0; }
+main { max-width: 34em; margin: 10vh auto; background: #fff; padding: 2em; border-radius: 8px; box-shadow: 0 1px 4px rgba(0,0,0,.15); }
+h1 { font-size: 1.4em; margin-top: 0; }
+.target { word-break: break-all; font-family: monospace; background: #f4f5f7; padding: .5em; border-radius: 4px; }
+a.button { display: inline-block; margin-top: 1em; padding: .6em 1.2em; background: #1a73e8; color: #fff; text-decoration: none; border-radius: 4px; }
+</style>`
+
+var leavingTemplate = template.Must(template.New("leaving").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>You are leaving</title>
+` + pageStyle + `
+</head>
+<body>
+<main>
+<h1>You are leaving</h1>
+<p>The link you clicked goes to a site we don't recognise:</p>
+<p class="target">{{.}}</p>
+<p>Only continue if you trust this site.</p>
+<a class="button" href="{{.}}" rel="noopener noreferrer">Continue</a>
+</main>
+</body>
+</html>
+`))
+
+// leavingPage serves the "you are leaving" page, letting the user choose whether to continue to target
+func leavingPage(w http.ResponseWriter, target string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(http.StatusOK)
+	if err := leavingTemplate.Execute(w, target); err != nil {
+		slog.Warn("http.ResponseWriter error", "error", err)
+	}
+}
+
+var errorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Link not recognised</title>
+` + pageStyle + `
+</head>
+<body>
+<main>
+<h1>Sorry, this link isn't working</h1>
+<p>The link you followed may have been broken across lines by your email program, or only partly copied.</p>
+<p>Try clicking the link in the original email again, or copy the whole link into your browser.</p>
+</main>
+</body>
+</html>
+`))
+
+// errorPage responds with Bad Request. Browsers are shown a page explaining the link is broken; other clients get no body.
+func errorPage(w http.ResponseWriter, req *http.Request) {
+	if !strings.Contains(req.Header.Get("Accept"), "text/html") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusBadRequest)
+	if err := errorTemplate.Execute(w, nil); err != nil {
+		slog.Warn("http.ResponseWriter error", "error", err)
+	}
+}
@@ -0,0 +1,90 @@
+package sparkypmtatracking
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+)
+
+// RepairPath attempts to recover a link path damaged on the way to the tracker, e.g. by mail clients that wrap long lines,
+// or by copy/paste. It removes characters that can't be part of a link (whitespace, slashes, brackets, quotes),
+// leftover quoted-printable soft line breaks, and leading / trailing punctuation, then restores base64 padding.
+// Returns the repaired path, and true if it was changed.
+func RepairPath(p string) (string, bool) {
+	orig := strings.TrimPrefix(p, "/")
+	p = strings.ReplaceAll(orig, "=3D", "=") // quoted-printable encoded "="
+	p = strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || strings.ContainsRune("-_=.", r) {
+			return r
+		}
+		return -1
+	}, p)
+	p = strings.Trim(p, ".")
+	data, sig := splitSignature(p)
+	data = strings.ReplaceAll(data, "=", "") // padding is only valid at the end, so any "=" elsewhere is a soft line break
+	if n := len(data) % 4; n > 1 {
+		data += strings.Repeat("=", 4-n)
+	}
+	if sig != "" {
+		data += "." + sig
+	}
+	return data, data != orig
+}
+
+// decodeTruncatedPath recovers what it can from a link path that has lost characters from the end.
+// The complete fields at the start of the JSON are kept; the link is only usable if the action and message ID survived,
+// and for clicks, the target URL.
+func decodeTruncatedPath(s string) (WrapperData, error) {
+	var wd WrapperData
+	s = strings.TrimRight(s, "=")
+	s = s[:len(s)-len(s)%4] // drop any partial group of base64 characters
+	zData, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return wd, err
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(zData))
+	if err != nil {
+		return wd, err
+	}
+	defer zr.Close()
+	var dBuf bytes.Buffer
+	if _, err := io.Copy(&dBuf, zr); err != nil && err != io.ErrUnexpectedEOF {
+		return wd, err
+	}
+	// Read complete "key":"value" pairs, stopping at the truncation
+	fields := make(map[string]string)
+	dec := json.NewDecoder(&dBuf)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return wd, errors.New("Link data is not a JSON object")
+	}
+	for {
+		k, err := dec.Token()
+		if err != nil {
+			break
+		}
+		v, err := dec.Token()
+		if err != nil {
+			break
+		}
+		key, kOK := k.(string)
+		val, vOK := v.(string)
+		if !kOK || !vOK {
+			break
+		}
+		fields[key] = val
+	}
+	wd = WrapperData{
+		Action:        fields["act"],
+		TargetLinkURL: fields["t_url"],
+		MessageID:     fields["msg_id"],
+		RcptTo:        fields["rcpt"],
+	}
+	if ActionToType(wd.Action) == "" || wd.MessageID == "" || (wd.Action == "c" && wd.TargetLinkURL == "") {
+		return wd, errors.New("Link could not be repaired")
+	}
+	return wd, nil
+}
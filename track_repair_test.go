@@ -0,0 +1,54 @@
+package sparkypmtatracking_test
+
+import (
+	"strings"
+	"testing"
+
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+func TestRepairPath(t *testing.T) {
+	msgID := spmta.UniqMessageID()
+	recip := RandomRecipient()
+	target := RandomURLWithPath()
+	link, err := spmta.EncodeLink("https://track.example.com", "click", msgID, recip, target, true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := strings.TrimPrefix(link, "https://track.example.com/"+spmta.FullLinkPrefix)
+	mid := len(p) / 2
+	damaged := []string{
+		p,
+		p + ">",
+		p + ").",
+		p + "/",
+		"/" + p[1:mid] + "=\r\n" + p[mid:], // quoted-printable soft line break
+		"/" + p[1:mid] + "=3D\n" + p[mid:], // with encoded "=" left behind
+		"/" + p[1:mid] + " " + p[mid:],     // space inserted when wrapping
+		"/" + p[1:mid] + "/" + p[mid:],     // slash inserted
+		"/" + strings.TrimRight(p[1:], "=") + `"'`, // lost padding, trailing quotes
+	}
+	for i, d := range damaged {
+		r, changed := spmta.RepairPath(d)
+		if changed != (i > 0) {
+			t.Errorf("RepairPath(%q) changed = %v", d, changed)
+		}
+		_, wd, _, err := spmta.DecodeLink("https://track.example.com/" + spmta.FullLinkPrefix + "/" + r)
+		if err != nil || wd.TargetLinkURL != target || wd.MessageID != msgID || wd.RcptTo != recip {
+			t.Errorf("Repaired path %q did not decode: %v %v", d, wd, err)
+		}
+	}
+
+	// Signed links keep their signature
+	key := []byte("key")
+	signed := spmta.SignPath(p[1:], key)
+	r, _ := spmta.RepairPath("/" + signed[:mid] + "\n" + signed[mid:] + ".")
+	if _, err := spmta.VerifyPath(r, key); err != nil {
+		t.Errorf("Repaired signed path: %v", err)
+	}
+
+	// Nothing left
+	if r, _ := spmta.RepairPath("/~~~~"); r != "" {
+		t.Errorf("Expected empty path, got %q", r)
+	}
+}
@@ -2,12 +2,19 @@ package sparkypmtatracking
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
 	"net"
 	"net/http"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // TransparentGif contains the bytes that should be served back to the client for an open pixel
@@ -18,10 +25,41 @@ var TransparentGif = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\xff\xff\xff" +
 // XRealIPHeader is a header that will be used, if provided (e.g. from NGINX)
 const XRealIPHeader = "X-Real-Ip"
 
+// Tracker serves tracking requests. With a nil Config, requests for any host are accepted and links are not checked for signatures.
+// Short links are looked up in Links, and encrypted links decrypted with Keys; if nil, these forms are not accepted.
+// Events are pushed onto RedisQueue, or with Stream set, added to RedisStream for a consumer group of feeders.
+// If Limit is set, it caps the events waiting.
+type Tracker struct {
+	Config *TrackerConfig
+	Links  LinkStore
+	Keys   *LinkKeys
+	Stream bool
+	Limit  *QueueLimit
+}
+
+// NewTracker returns a tracker using the per-host settings in cfg, looking up short links in Redis
+func NewTracker(cfg *TrackerConfig) *Tracker {
+	return &Tracker{Config: cfg, Links: NewRedisLinkStore(MyRedis(), LinkTTL)}
+}
+
+// defaultTracker serves TrackingServer, created on first use so that importing the package doesn't connect to Redis
+var (
+	defaultTracker     *Tracker
+	defaultTrackerOnce sync.Once
+)
+
 // TrackingServer expects URL paths of the form /xyzzy
 // where xyzzy = base64 urlsafe encoded, Zlib compressed, []byte
+// or short links of the form /s/id, where id is looked up in Redis.
+// Encrypted links, of the form /e/xyzzy, are not accepted.
 // These are written to the Redis queue
 func TrackingServer(w http.ResponseWriter, req *http.Request) {
+	defaultTrackerOnce.Do(func() { defaultTracker = NewTracker(nil) })
+	defaultTracker.ServeHTTP(w, req)
+}
+
+// ServeHTTP handles a tracking request, checking it against the settings for the requested host
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// Emulate what SparkPost engagement tracker endpoint does. Necessary only for testing with bouncy sink.
 	w.Header().Set("Server", "msys-http")
 	switch req.Method {
@@ -33,12 +71,40 @@ func TrackingServer(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	s := strings.Split(req.URL.Path, "/")
-	if s[0] != "" || len(s) != 2 || len(s[1]) <= 0 {
-		log.Println("Incoming URL error:", req.URL.Path)
-		w.WriteHeader(http.StatusBadRequest)
+	// Continue the trace of a proxy in front of us, if it sent one
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	_, span := tracer.Start(ctx, "tracker.request", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.host", req.Host), attribute.String("url.path", req.URL.Path)))
+	defer span.End()
+
+	var host *TrackingHost
+	if t.Config != nil {
+		if host = t.Config.Host(req.Host); host == nil {
+			slog.Warn("Unknown tracking host", "host", req.Host)
+			span.SetStatus(codes.Error, "unknown tracking host")
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			return
+		}
+	}
+	form, reqPath := splitLinkPrefix(req.URL.Path)
+	linkPath, repaired := RepairPath(reqPath)
+	if linkPath == "" {
+		slog.Warn("Link error", "reason", "path", "path", req.URL.Path)
+		linkError(span, "path")
+		host.fallback(w, req)
 		return
 	}
+	if host != nil && host.SigningKey != "" {
+		var err error
+		if linkPath, err = VerifyPath(linkPath, []byte(host.SigningKey)); err != nil {
+			slog.Warn("Link error", "reason", "signature", "path", req.URL.Path, "error", err)
+			linkError(span, "signature")
+			host.fallback(w, req)
+			return
+		}
+	} else {
+		linkPath, _ = splitSignature(linkPath) // signature is not checked here
+	}
 	var e TrackEvent
 	e.UserAgent = req.UserAgent()
 	// Look for the original client IP from Nginx, if present - check syntax then use it
@@ -46,7 +112,7 @@ func TrackingServer(w http.ResponseWriter, req *http.Request) {
 		if checkedIP := net.ParseIP(xRealIP); checkedIP != nil {
 			e.IPAddress = checkedIP.String()
 		} else {
-			log.Printf("Invalid %s header found=%s\n", XRealIPHeader, xRealIP)
+			slog.Warn("Invalid header", "header", XRealIPHeader, "value", xRealIP)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
@@ -56,34 +122,84 @@ func TrackingServer(w http.ResponseWriter, req *http.Request) {
 
 	e.TimeStamp = strconv.FormatInt(time.Now().Unix(), 10)
 
-	eBytes, err := DecodePath(s[1])
+	format := linkFormats[form]
+	eBytes, err := format.decode(linkPath, t.Links, t.Keys)
+	if err == nil {
+		err = json.Unmarshal(eBytes, &e.WD)
+	}
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		if errors.Is(err, ErrLinkStore) {
+			slog.Error("Link store error", "path", req.URL.Path, "error", err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "link store error")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// The end of the link may have been lost - recover what we can
+		var truncErr error = err
+		if format.truncatable {
+			e.WD, truncErr = decodeTruncatedPath(linkPath)
+		}
+		if truncErr != nil {
+			slog.Warn("Link error", "reason", format.errorReason, "path", req.URL.Path, "error", err)
+			linkError(span, format.errorReason)
+			host.fallback(w, req)
+			return
+		}
+		slog.Info("Repaired link", "kind", "truncated", "path", req.URL.Path)
+		LinksRepaired.WithLabelValues("truncated").Inc()
+		repaired = false
 	}
-	if err = json.Unmarshal(eBytes, &e.WD); err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	if repaired {
+		slog.Info("Repaired link", "kind", "cleaned", "path", req.URL.Path)
+		LinksRepaired.WithLabelValues("cleaned").Inc()
 	}
 	// Build the composite info ready to push into the Redis queue
 	eBytes, err = json.Marshal(e)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Event encoding error", "error", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	span.SetAttributes(attribute.String("action", ActionToType(e.WD.Action)), MessageIDAttr.String(e.WD.MessageID))
+
+	// Clicks are checked against the host's redirect lists first, so clicks not sent to their target are not recorded
+	var target string
+	if e.WD.Action == "c" {
+		// Any query parameters on the tracking link are passed on to the target
+		target = MergeQuery(e.WD.TargetLinkURL, req.URL.Query())
+		switch verdict, reason := host.CheckRedirect(target); verdict {
+		case RedirectConfirm:
+			slog.Info("Redirect target not on allow list", "message_id", e.WD.MessageID, "url", target)
+			RedirectsBlocked.WithLabelValues(reason).Inc()
+			span.SetAttributes(attribute.String("redirect.blocked", reason))
+			leavingPage(w, target)
+			return
+		case RedirectBlocked:
+			slog.Warn("Redirect target blocked", "reason", reason, "message_id", e.WD.MessageID, "url", target)
+			RedirectsBlocked.WithLabelValues(reason).Inc()
+			span.SetAttributes(attribute.String("redirect.blocked", reason))
+			host.fallback(w, req)
+			return
+		}
+	}
 	// Log information received
-	log.Printf("Timestamp %s, IPAddress %s, UserAgent %s, Action %s, URL %s, MsgID %s\n", e.TimeStamp, e.IPAddress, e.UserAgent, e.WD.Action, e.WD.TargetLinkURL, e.WD.MessageID)
+	slog.Info("Tracking event", "action", ActionToType(e.WD.Action), "message_id", e.WD.MessageID, "url", e.WD.TargetLinkURL,
+		"ip", e.IPAddress, "user_agent", e.UserAgent, "timestamp", e.TimeStamp)
 
 	client := MyRedis()
 	defer client.Close()
-	if _, err = client.RPush(RedisQueue, eBytes).Result(); err != nil {
-		log.Println("Redis error", err)
+	queued, err := t.enqueue(client, eBytes)
+	if err != nil {
+		slog.Error("Redis error", "message_id", e.WD.MessageID, "error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "redis error")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if queued {
+		TrackerEvents.WithLabelValues(ActionToType(e.WD.Action)).Inc()
+	}
 
 	switch e.WD.Action {
 	case "o":
@@ -92,11 +208,28 @@ func TrackingServer(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Content-Type", "image/gif")
 		w.Header().Set("Cache-Control", "no-cache, max-age=0")
 		if _, err = w.Write(TransparentGif); err != nil {
-			log.Println("http.ResponseWriter error", err)
+			slog.Warn("http.ResponseWriter error", "error", err)
 		}
 	case "c":
 		w.Header().Set("Content-Type", "text/plain")
-		w.Header().Set("Location", e.WD.TargetLinkURL)
+		w.Header().Set("Location", target)
 		w.WriteHeader(http.StatusFound)
 	}
 }
+
+// linkError counts a link that could not be used, and marks the request span as failed
+func linkError(span trace.Span, reason string) {
+	LinkErrors.WithLabelValues(reason).Inc()
+	span.SetStatus(codes.Error, "link error: "+reason)
+}
+
+// fallback redirects the client to the host's fallback URL, if there is one, otherwise responds with the error page
+func (h *TrackingHost) fallback(w http.ResponseWriter, req *http.Request) {
+	if h == nil || h.FallbackURL == "" {
+		errorPage(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Location", h.FallbackURL)
+	w.WriteHeader(http.StatusFound)
+}
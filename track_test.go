@@ -5,14 +5,21 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	spmta "github.com/tuck1s/sparkypmtatracking"
 )
 
 // runHTTPTest wrapper convenience function
 func runHTTPTest(t *testing.T, method string, reqURL string, expectCode int, expectBody []byte, client *redis.Client, realIPHeader string) {
+	runHandlerTest(t, http.HandlerFunc(spmta.TrackingServer), method, reqURL, expectCode, expectBody, client, realIPHeader)
+}
+
+// runHandlerTest makes a request to handler, checks the response, and returns the response Location header
+func runHandlerTest(t *testing.T, handler http.Handler, method string, reqURL string, expectCode int, expectBody []byte, client *redis.Client, realIPHeader string) string {
 	emptyRedisQueue(client)
 
 	req, err := http.NewRequest(method, reqURL, nil)
@@ -23,7 +30,6 @@ func runHTTPTest(t *testing.T, method string, reqURL string, expectCode int, exp
 		req.Header.Set(spmta.XRealIPHeader, realIPHeader) // example value
 	}
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(spmta.TrackingServer)
 	handler.ServeHTTP(rr, req)
 
 	// Check the status code is what we expect.
@@ -47,6 +53,7 @@ func runHTTPTest(t *testing.T, method string, reqURL string, expectCode int, exp
 			t.Error(err)
 		}
 	}
+	return rr.Header().Get("Location")
 }
 
 // Make pseudo http requests in, check Redis queue contents comes out
@@ -130,3 +137,301 @@ func TestTrackingServerFaultyInputs(t *testing.T) {
 	// clean up after
 	client.Del(spmta.RedisQueue)
 }
+
+const testTrackerConfig = `{
+	"hosts": {
+		"track.brand-one.example.com": {
+			"signing_key": "brand one secret",
+			"allowed_redirect_domains": ["brand-one.example.com"],
+			"fallback_url": "https://www.brand-one.example.com/"
+		},
+		"Track.Brand-Two.example.com": {}
+	}
+}`
+
+func TestTrackerPerHost(t *testing.T) {
+	var empty []byte
+	client := spmta.MyRedis()
+	cfg, err := spmta.ReadTrackerConfig(strings.NewReader(testTrackerConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := spmta.NewTracker(cfg)
+	msgID := spmta.UniqMessageID()
+	recip := RandomRecipient()
+	const target = "https://shop.brand-one.example.com/offer"
+	const fallback = "https://www.brand-one.example.com/"
+
+	// Signed link to an allowed domain
+	w, err := spmta.NewWrapper("https://track.brand-one.example.com", true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetSigningKey("brand one secret")
+	w.SetMessageInfo(msgID, recip)
+	loc := runHandlerTest(t, tracker, "GET", w.WrapURL(target), http.StatusFound, empty, client, "")
+	if loc != target {
+		t.Errorf("Redirected to %s, expected %s", loc, target)
+	}
+	// Opens work too, and port number in the Host is ignored
+	openURL := strings.Replace(w.OpenPixel(), "track.brand-one.example.com", "track.brand-one.example.com:8443", 1)
+	openURL = openURL[strings.Index(openURL, "https://"):strings.LastIndex(openURL, `"`)]
+	runHandlerTest(t, tracker, "GET", openURL, http.StatusOK, spmta.TransparentGif, client, "")
+
+	// Signed link to a domain that's not allowed gets the "you are leaving" page
+	checkLeavingPage(t, tracker, w.WrapURL("https://elsewhere.example.org/"), "https://elsewhere.example.org/")
+
+	// Unsigned link and tampered signature are not accepted
+	unsigned, err := spmta.EncodeLink("https://track.brand-one.example.com", "click", msgID, recip, target, true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc = runHandlerTest(t, tracker, "GET", unsigned, http.StatusFound, empty, client, "")
+	if loc != fallback {
+		t.Errorf("Redirected to %s, expected %s", loc, fallback)
+	}
+	loc = runHandlerTest(t, tracker, "GET", unsigned+".AAAAAAAAAAAAAAAAAAAAAA", http.StatusFound, empty, client, "")
+	if loc != fallback {
+		t.Errorf("Redirected to %s, expected %s", loc, fallback)
+	}
+
+	// Host with no settings accepts any unsigned link, and host name matching is case-insensitive
+	link2, err := spmta.EncodeLink("https://track.brand-two.example.com", "click", msgID, recip, "https://example.org/", true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runHandlerTest(t, tracker, "GET", link2, http.StatusFound, empty, client, "")
+	// Host with no fallback gives Bad Request for faulty links
+	runHandlerTest(t, tracker, "GET", "https://track.brand-two.example.com/not_a_valid_path", http.StatusBadRequest, empty, client, "")
+
+	// Unknown hosts are rejected
+	link3, err := spmta.EncodeLink("https://track.unknown.example.com", "click", msgID, recip, target, true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runHandlerTest(t, tracker, "GET", link3, http.StatusMisdirectedRequest, empty, client, "")
+}
+
+// checkLeavingPage requests reqURL and checks the "you are leaving" page is served, linking to target
+func checkLeavingPage(t *testing.T, handler http.Handler, reqURL, target string) {
+	req := httptest.NewRequest("GET", reqURL, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("Expected leaving page, got status %d, Content-Type %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if rr.Header().Get("Location") != "" {
+		t.Errorf("Leaving page should not redirect")
+	}
+	if !strings.Contains(rr.Body.String(), `href="`+target+`"`) {
+		t.Errorf("Leaving page does not link to %s: %s", target, rr.Body.String())
+	}
+}
+
+const testRedirectConfig = `{
+	"hosts": {
+		"track.example.com": {
+			"allowed_redirect_domains": ["example.com"],
+			"denied_redirect_domains": ["bad.example.com"],
+			"fallback_url": "https://www.example.com/oops"
+		}
+	}
+}`
+
+func TestTrackerRedirectChecks(t *testing.T) {
+	var empty []byte
+	client := spmta.MyRedis()
+	cfg, err := spmta.ReadTrackerConfig(strings.NewReader(testRedirectConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := spmta.NewTracker(cfg)
+	link := func(trackingURL, target string) string {
+		l, err := spmta.EncodeLink(trackingURL, "click", spmta.UniqMessageID(), RandomRecipient(), target, true, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	before := testutil.ToFloat64(spmta.RedirectsBlocked.WithLabelValues("scheme"))
+
+	// Allowed target
+	if loc := runHandlerTest(t, tracker, "GET", link("https://track.example.com", "https://shop.example.com/"), http.StatusFound, empty, client, ""); loc != "https://shop.example.com/" {
+		t.Errorf("Unexpected redirect to %s", loc)
+	}
+	// Denied scheme and denied domain go to the fallback
+	for _, target := range []string{"javascript:alert(1)", "https://bad.example.com/phish", "ftp://example.com/file"} {
+		if loc := runHandlerTest(t, tracker, "GET", link("https://track.example.com", target), http.StatusFound, empty, client, ""); loc != "https://www.example.com/oops" {
+			t.Errorf("Target %s redirected to %s", target, loc)
+		}
+		if n := client.LLen(spmta.RedisQueue).Val(); n != 0 {
+			t.Errorf("Blocked click to %s recorded as an event", target)
+		}
+	}
+	// Target outside the allow list gets the leaving page, with the URL escaped
+	target := `https://other.example.net/?a=1&b="2"`
+	req := httptest.NewRequest("GET", link("https://track.example.com", target), nil)
+	rr := httptest.NewRecorder()
+	tracker.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), `b="2"`) || !strings.Contains(rr.Body.String(), "other.example.net") {
+		t.Errorf("Unexpected leaving page %d %s", rr.Code, rr.Body.String())
+	}
+	if n := client.LLen(spmta.RedisQueue).Val(); n != 0 {
+		t.Errorf("Click to the leaving page recorded as an event")
+	}
+
+	// With no config, only the scheme is checked
+	runHandlerTest(t, http.HandlerFunc(spmta.TrackingServer), "GET", link(RandomBaseURL(), "javascript:alert(1)"), http.StatusBadRequest, empty, client, "")
+	runHandlerTest(t, http.HandlerFunc(spmta.TrackingServer), "GET", link(RandomBaseURL(), "mailto:bob@example.com"), http.StatusFound, empty, client, "")
+
+	if after := testutil.ToFloat64(spmta.RedirectsBlocked.WithLabelValues("scheme")); after-before != 3 {
+		t.Errorf("Expected 3 blocked redirects counted, got %v", after-before)
+	}
+}
+
+func TestTrackerDamagedLinks(t *testing.T) {
+	var empty []byte
+	client := spmta.MyRedis()
+	msgID := spmta.UniqMessageID()
+	target := RandomURLWithPath()
+	link, err := spmta.EncodeLink(RandomBaseURL(), "click", msgID, RandomRecipient(), target, true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repairedBefore := testutil.ToFloat64(spmta.LinksRepaired.WithLabelValues("truncated"))
+	errorsBefore := testutil.ToFloat64(spmta.LinkErrors.WithLabelValues("decode"))
+
+	// Lost the last few characters - recipient is lost, but the click still goes to the target
+	loc := runHTTPTest2(t, link[:len(link)-12], http.StatusFound, "")
+	if loc != target {
+		t.Errorf("Truncated link redirected to %s, expected %s", loc, target)
+	}
+	// Quoted-printable soft line break left in the link
+	mid := len(link) - 20
+	loc = runHTTPTest2(t, link[:mid]+"=%0D%0A"+link[mid:], http.StatusFound, "")
+	if loc != target {
+		t.Errorf("Damaged link redirected to %s, expected %s", loc, target)
+	}
+	if got := testutil.ToFloat64(spmta.LinksRepaired.WithLabelValues("truncated")) - repairedBefore; got != 1 {
+		t.Errorf("Expected 1 truncated link repaired, got %v", got)
+	}
+
+	// Link that can't be repaired gets the error page in browsers, empty body otherwise
+	short := link[:strings.LastIndex(link, "/")+10]
+	runHTTPTest(t, "GET", short, http.StatusBadRequest, empty, client, "")
+	runHTTPTest2(t, short, http.StatusBadRequest, "text/html,application/xhtml+xml,*/*;q=0.8")
+	if got := testutil.ToFloat64(spmta.LinkErrors.WithLabelValues("decode")) - errorsBefore; got != 2 {
+		t.Errorf("Expected 2 link errors counted, got %v", got)
+	}
+}
+
+// runHTTPTest2 makes a tracking request with the given Accept header, checks the status code, and returns the Location header.
+// If the client accepts html, checks that error responses are an html page.
+func runHTTPTest2(t *testing.T, reqURL string, expectCode int, accept string) string {
+	req := httptest.NewRequest("GET", reqURL, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rr := httptest.NewRecorder()
+	spmta.TrackingServer(rr, req)
+	if rr.Code != expectCode {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, expectCode)
+	}
+	if expectCode == http.StatusBadRequest && accept != "" && !strings.Contains(rr.Body.String(), "<h1>") {
+		t.Errorf("Expected html error page, got %s", rr.Body.String())
+	}
+	return rr.Header().Get("Location")
+}
+
+func TestTrackerShortLinks(t *testing.T) {
+	var empty []byte
+	client := spmta.MyRedis()
+	store := spmta.NewMemoryLinkStore()
+	tracker := spmta.NewTracker(nil)
+	tracker.Links = store
+	w, err := spmta.NewWrapper(RandomBaseURL(), true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetLinkStore(store)
+	w.SetMessageInfo(spmta.UniqMessageID(), RandomRecipient())
+	target := RandomURLWithPath()
+	if loc := runHandlerTest(t, tracker, "GET", w.WrapURL(target), http.StatusFound, empty, client, ""); loc != target {
+		t.Errorf("Short link redirected to %s, expected %s", loc, target)
+	}
+	// Id not in the store
+	runHandlerTest(t, tracker, "GET", w.URL.String()+"/s/AAAAAAAAAAAAAAAA", http.StatusBadRequest, empty, client, "")
+	// Tracker without a link store
+	tracker.Links = nil
+	runHandlerTest(t, tracker, "GET", w.WrapURL(target), http.StatusBadRequest, empty, client, "")
+}
+
+func TestTrackerEncryptedLinks(t *testing.T) {
+	var empty []byte
+	client := spmta.MyRedis()
+	keys, err := spmta.ReadLinkKeys(strings.NewReader(testLinkKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := spmta.NewTracker(nil)
+	tracker.Keys = keys
+	w, err := spmta.NewWrapper(RandomBaseURL(), true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetLinkKeys(keys)
+	w.SetMessageInfo(spmta.UniqMessageID(), RandomRecipient())
+	target := RandomURLWithPath()
+	link := w.WrapURL(target)
+	if loc := runHandlerTest(t, tracker, "GET", link, http.StatusFound, empty, client, ""); loc != target {
+		t.Errorf("Encrypted link redirected to %s, expected %s", loc, target)
+	}
+	// Full links are still accepted
+	full, err := spmta.EncodeLink(RandomBaseURL(), "click", spmta.UniqMessageID(), RandomRecipient(), target, true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runHandlerTest(t, tracker, "GET", full, http.StatusFound, empty, client, "")
+	// Tracker without the keys
+	runHandlerTest(t, http.HandlerFunc(spmta.TrackingServer), "GET", link, http.StatusBadRequest, empty, client, "")
+}
+
+// Links made by every version of the wrapper must keep working
+func TestTrackerGoldenLinks(t *testing.T) {
+	client := spmta.MyRedis()
+	golden, keys, store := readGoldenLinks(t)
+	tracker := spmta.NewTracker(nil)
+	tracker.Links = store
+	tracker.Keys = keys
+	for _, g := range golden {
+		switch g.Data.Action {
+		case "c":
+			if loc := runHandlerTest(t, tracker, "GET", g.Link, http.StatusFound, nil, client, ""); loc != g.Data.TargetLinkURL {
+				t.Errorf("%s: redirected to %s, expected %s", g.Name, loc, g.Data.TargetLinkURL)
+			}
+		default:
+			runHandlerTest(t, tracker, "GET", g.Link, http.StatusOK, spmta.TransparentGif, client, "")
+		}
+	}
+}
+
+func TestTrackerMergeQuery(t *testing.T) {
+	var empty []byte
+	client := spmta.MyRedis()
+	w, err := spmta.NewWrapper(RandomBaseURL()+"?src=newsletter", true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetMessageInfo(spmta.UniqMessageID(), RandomRecipient())
+	link := w.WrapURL("https://example.com/page?id=1&src=web")
+	if loc := runHTTPTest2(t, link, http.StatusFound, ""); loc != "https://example.com/page?id=1&src=web" {
+		t.Errorf("Target parameters should take precedence, got %s", loc)
+	}
+	if loc := runHTTPTest2(t, link+"&ref=footer", http.StatusFound, ""); loc != "https://example.com/page?id=1&src=web&ref=footer" {
+		t.Errorf("Extra parameters not merged, got %s", loc)
+	}
+	link = w.WrapURL("https://example.com/page")
+	if loc := runHandlerTest(t, http.HandlerFunc(spmta.TrackingServer), "GET", link, http.StatusFound, empty, client, ""); loc != "https://example.com/page?src=newsletter" {
+		t.Errorf("Tracking URL parameters not merged, got %s", loc)
+	}
+}
@@ -0,0 +1,35 @@
+package sparkypmtatracking
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// TrackerTLSConfig returns TLS settings suited to the tracker serving https directly (without NGINX in front).
+// Session tickets are left enabled, so returning clients can resume quickly. HTTP/2 is negotiated by net/http.
+// The caller adds certificates, or a GetCertificate function.
+func TrackerTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:             tls.VersionTLS12,
+		CurvePreferences:       []tls.CurveID{tls.X25519, tls.CurveP256},
+		SessionTicketsDisabled: false,
+		NextProtos:             []string{"h2", "http/1.1"},
+	}
+}
+
+// HTTPSRedirect returns a handler that redirects plain http requests to the same host and path on https.
+// httpsPort should be blank or "443" for the standard port.
+func HTTPSRedirect(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		w.Header().Set("Server", "msys-http")
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,53 @@
+package sparkypmtatracking_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+func TestTrackerTLSConfigHTTP2(t *testing.T) {
+	// httptest provides a self-signed cert; the client returned by the server trusts it
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(spmta.TransparentGif)
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = spmta.TrackerTLSConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	res, err := srv.Client().Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2, got %s", res.Proto)
+	}
+	if res.TLS == nil || res.TLS.Version < 0x0303 {
+		t.Errorf("Expected TLS 1.2 or later")
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	cases := []struct {
+		port, reqURL, expected string
+	}{
+		{"", "http://track.example.com/eJxUzLEOQiEMRuF3", "https://track.example.com/eJxUzLEOQiEMRuF3"},
+		{"443", "http://track.example.com:80/abc?x=1", "https://track.example.com/abc?x=1"},
+		{"8443", "http://track.example.com:8080/abc", "https://track.example.com:8443/abc"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.reqURL, nil)
+		rr := httptest.NewRecorder()
+		spmta.HTTPSRedirect(c.port).ServeHTTP(rr, req)
+		if rr.Code != http.StatusMovedPermanently {
+			t.Errorf("Unexpected status %d", rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != c.expected {
+			t.Errorf("Redirect to %s, expected %s", loc, c.expected)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package sparkypmtatracking
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook body formats
+const (
+	WebhookFormatEvents = "events" // JSON array of events, e.g. [{"type":"click","message_id":"..."}]
+	WebhookFormatMsys   = "msys"   // as sent by SparkPost webhooks, e.g. [{"msys":{"track_event":{"type":"click", ...}}}]
+)
+
+// Webhook auth types, as for SparkPost webhooks
+const (
+	WebhookAuthBasic  = "basic"
+	WebhookAuthOAuth2 = "oauth2"
+)
+
+// WebhookSignatureHeader carries the HMAC-SHA256 signature of the webhook body, as "sha256=" followed by hex digits
+const WebhookSignatureHeader = "X-Signature"
+
+// Retry defaults for webhook endpoints
+const (
+	WebhookDefaultRetries    = 3
+	WebhookDefaultBackoff    = time.Second
+	WebhookDefaultMaxBackoff = time.Minute
+)
+
+// WebhookAuth holds the credentials for a webhook endpoint
+type WebhookAuth struct {
+	Type         string `json:"type"`          // basic or oauth2
+	Username     string `json:"username"`      // basic
+	Password     string `json:"password"`      // basic
+	TokenURL     string `json:"token_url"`     // oauth2, using the client credentials grant
+	ClientID     string `json:"client_id"`     // oauth2
+	ClientSecret string `json:"client_secret"` // oauth2
+}
+
+// WebhookConfig holds the settings for one webhook endpoint
+type WebhookConfig struct {
+	URL        string       `json:"url"`
+	Format     string       `json:"format"`      // msys (default) or events
+	Auth       *WebhookAuth `json:"auth"`        // Optional basic or OAuth 2.0 auth
+	AuthHeader string       `json:"auth_header"` // Optional header to send AuthValue in, e.g. X-API-Key
+	AuthValue  string       `json:"auth_value"`
+	HMACKey    string       `json:"hmac_key"`    // If set, the body is signed in WebhookSignatureHeader
+	Retries    *int         `json:"retries"`     // Times to retry a failed batch (default 3)
+	Backoff    string       `json:"backoff"`     // Wait before the first retry, doubling for each one after (default 1s)
+	MaxBackoff string       `json:"max_backoff"` // Longest wait between retries (default 1m)
+}
+
+// WebhookSink POSTs each batch to URL as a JSON array of events. Failed batches are retried with exponential backoff,
+// if the failure might be temporary, i.e. a network error, 429 or 5xx response.
+type WebhookSink struct {
+	URL        string
+	Format     string
+	Auth       *WebhookAuth
+	AuthHeader string // if set, sent with AuthValue, e.g. Authorization: Bearer ...
+	AuthValue  string
+	HMACKey    []byte // if set, the body is signed in WebhookSignatureHeader
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Client     *http.Client
+
+	mu          sync.Mutex // protects the OAuth 2.0 access token
+	accessToken string
+	tokenExpiry time.Time
+}
+
+// LoadWebhooks reads a JSON file of webhook endpoints
+func LoadWebhooks(filename string) ([]*WebhookSink, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadWebhooks(f)
+}
+
+// ReadWebhooks reads a JSON array of webhook endpoint settings from r, and makes a sink for each
+func ReadWebhooks(r io.Reader) ([]*WebhookSink, error) {
+	var configs []WebhookConfig
+	if err := json.NewDecoder(r).Decode(&configs); err != nil {
+		return nil, err
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("Webhooks file has no endpoints")
+	}
+	sinks := make([]*WebhookSink, len(configs))
+	for i, c := range configs {
+		s, err := NewWebhookSink(c)
+		if err != nil {
+			return nil, fmt.Errorf("Webhook %d: %v", i+1, err)
+		}
+		sinks[i] = s
+	}
+	return sinks, nil
+}
+
+// NewWebhookSink checks c, and returns a sink for the endpoint
+func NewWebhookSink(c WebhookConfig) (*WebhookSink, error) {
+	if _, err := url.ParseRequestURI(c.URL); err != nil {
+		return nil, fmt.Errorf("url: %v", err)
+	}
+	s := &WebhookSink{
+		URL:        c.URL,
+		Format:     c.Format,
+		AuthHeader: c.AuthHeader,
+		AuthValue:  c.AuthValue,
+		HMACKey:    []byte(c.HMACKey),
+		Retries:    WebhookDefaultRetries,
+		Backoff:    WebhookDefaultBackoff,
+		MaxBackoff: WebhookDefaultMaxBackoff,
+	}
+	switch s.Format {
+	case "":
+		s.Format = WebhookFormatMsys
+	case WebhookFormatEvents, WebhookFormatMsys:
+	default:
+		return nil, fmt.Errorf("unknown format %q", c.Format)
+	}
+	if a := c.Auth; a != nil {
+		switch a.Type {
+		case WebhookAuthBasic:
+			if a.Username == "" {
+				return nil, errors.New("basic auth needs a username")
+			}
+		case WebhookAuthOAuth2:
+			if _, err := url.ParseRequestURI(a.TokenURL); err != nil || a.ClientID == "" {
+				return nil, errors.New("oauth2 auth needs a token_url and client_id")
+			}
+		default:
+			return nil, fmt.Errorf("unknown auth type %q", a.Type)
+		}
+		s.Auth = a
+	}
+	if c.Retries != nil {
+		if *c.Retries < 0 {
+			return nil, errors.New("retries can't be negative")
+		}
+		s.Retries = *c.Retries
+	}
+	var err error
+	if c.Backoff != "" {
+		if s.Backoff, err = time.ParseDuration(c.Backoff); err != nil {
+			return nil, fmt.Errorf("backoff: %v", err)
+		}
+	}
+	if c.MaxBackoff != "" {
+		if s.MaxBackoff, err = time.ParseDuration(c.MaxBackoff); err != nil {
+			return nil, fmt.Errorf("max_backoff: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// Name of the sink
+func (s *WebhookSink) Name() string { return SinkWebhook }
+
+// Send POSTs b to the webhook URL, retrying as needed. Any 2xx response is success.
+func (s *WebhookSink) Send(ctx context.Context, b *EventBatch) error {
+	body, err := s.body(b)
+	if err != nil {
+		return err
+	}
+	wait := s.Backoff
+	for attempt := 0; ; attempt++ {
+		var status string
+		status, err = s.post(ctx, body)
+		if err == nil {
+			slog.Info("Posted batch to webhook", "url", s.URL, "events", len(b.Events), "bytes", len(body), "status", status)
+			return nil
+		}
+		if attempt >= s.Retries || !s.retryable(err) {
+			return err
+		}
+		slog.Warn("Webhook failed, retrying", "url", s.URL, "attempt", attempt+1, "wait", wait, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		wait *= 2
+		if s.MaxBackoff > 0 && wait > s.MaxBackoff {
+			wait = s.MaxBackoff
+		}
+	}
+}
+
+// Close does nothing
+func (s *WebhookSink) Close() error { return nil }
+
+// body returns the events in b as a JSON array, in the endpoint's format
+func (s *WebhookSink) body(b *EventBatch) ([]byte, error) {
+	if s.Format == WebhookFormatMsys {
+		return json.Marshal(b.Events) // SparkPostEvent already has the msys nesting
+	}
+	events := make([]interface{}, len(b.Events))
+	for i := range b.Events {
+		events[i] = &b.Events[i].EventWrapper.EventGrouping
+	}
+	return json.Marshal(events)
+}
+
+// post makes one attempt at sending body
+func (s *WebhookSink) post(ctx context.Context, body []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.AuthHeader != "" {
+		req.Header.Set(s.AuthHeader, s.AuthValue)
+	}
+	if len(s.HMACKey) > 0 {
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(s.HMACKey, body))
+	}
+	if s.Auth != nil {
+		switch s.Auth.Type {
+		case WebhookAuthBasic:
+			req.SetBasicAuth(s.Auth.Username, s.Auth.Password)
+		case WebhookAuthOAuth2:
+			token, err := s.token(ctx)
+			if err != nil {
+				return "", fmt.Errorf("oauth2 token: %w", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	status, _, err := post(s.Client, req)
+	return status, err
+}
+
+// retryable returns true if err might go away by trying again. An OAuth 2.0 token that was refused is dropped, so
+// a new one is fetched.
+func (s *WebhookSink) retryable(err error) bool {
+	var se *StatusError
+	if !errors.As(err, &se) {
+		return true // network error
+	}
+	if se.Code == http.StatusUnauthorized && s.Auth != nil && s.Auth.Type == WebhookAuthOAuth2 {
+		s.mu.Lock()
+		s.accessToken = ""
+		s.mu.Unlock()
+		return true
+	}
+	return se.Code == http.StatusTooManyRequests || se.Code >= 500
+}
+
+// token returns an OAuth 2.0 access token from the token URL, using the client credentials grant.
+// Tokens are reused until shortly before they expire.
+func (s *WebhookSink) token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accessToken != "" && time.Now().Before(s.tokenExpiry) {
+		return s.accessToken, nil
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {s.Auth.ClientID},
+		"client_secret": {s.Auth.ClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.Auth.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	_, body, err := post(s.Client, req)
+	if err != nil {
+		return "", err
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err = json.Unmarshal(body, &t); err != nil {
+		return "", err
+	}
+	if t.AccessToken == "" {
+		return "", errors.New("no access_token in response")
+	}
+	lifetime := time.Hour // if the server doesn't say
+	if t.ExpiresIn > 0 {
+		lifetime = time.Duration(t.ExpiresIn) * time.Second
+	}
+	s.accessToken, s.tokenExpiry = t.AccessToken, time.Now().Add(lifetime*9/10)
+	return s.accessToken, nil
+}
+
+// SignWebhook returns the signature of body with key, as sent in WebhookSignatureHeader
+func SignWebhook(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,206 @@
+package sparkypmtatracking_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+func TestWebhookSink(t *testing.T) {
+	key := []byte("secret")
+	var got []map[string]interface{}
+	mock := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Authorization") != "Bearer xyzzy" ||
+			r.Header.Get(spmta.WebhookSignatureHeader) != spmta.SignWebhook(key, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := json.Unmarshal(body, &got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer mock.Close()
+
+	b := makeBatch(t, 3)
+	s := &spmta.WebhookSink{URL: mock.URL, AuthHeader: "Authorization", AuthValue: "Bearer xyzzy", HMACKey: key}
+	if err := s.Send(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0]["message_id"] != b.Events[0].EventWrapper.EventGrouping.MessageID || got[2]["type"] != "click" {
+		t.Errorf("Unexpected webhook body %v", got)
+	}
+
+	// Wrong signature is rejected
+	s.HMACKey = []byte("wrong")
+	if err := s.Send(context.Background(), b); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected an error, got %v", err)
+	}
+}
+
+// Batches can be sent as SparkPost webhooks are, with basic auth
+func TestWebhookMsys(t *testing.T) {
+	var got []spmta.SparkPostEvent
+	mock := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "crm" || pass != "pw" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer mock.Close()
+
+	s, err := spmta.NewWebhookSink(spmta.WebhookConfig{URL: mock.URL, Format: "msys",
+		Auth: &spmta.WebhookAuth{Type: "basic", Username: "crm", Password: "pw"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := makeBatch(t, 2)
+	if err = s.Send(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1] != b.Events[1] {
+		t.Errorf("Unexpected webhook body %+v", got)
+	}
+}
+
+// flakyServer fails with each of codes in turn, then succeeds. It returns the number of requests made.
+func flakyServer(t *testing.T, codes ...int) (*httptest.Server, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if int(n) <= len(codes) {
+			w.WriteHeader(codes[n-1])
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestWebhookRetry(t *testing.T) {
+	retries := 2
+	b := makeBatch(t, 1)
+	for _, c := range []struct {
+		codes     []int
+		wantCalls int32
+		wantErr   bool
+	}{
+		{[]int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, 3, false}, // succeeds on the last retry
+		{[]int{500, 502, 503}, 3, true},                                              // retries used up
+		{[]int{http.StatusBadRequest}, 1, true},                                      // not worth retrying
+	} {
+		srv, calls := flakyServer(t, c.codes...)
+		s, err := spmta.NewWebhookSink(spmta.WebhookConfig{URL: srv.URL, Retries: &retries, Backoff: "1ms", MaxBackoff: "2ms"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Send(context.Background(), b)
+		if (err != nil) != c.wantErr || *calls != c.wantCalls {
+			t.Errorf("Codes %v: got %v after %d calls", c.codes, err, *calls)
+		}
+	}
+
+	// Network errors are retried too
+	srv, _ := flakyServer(t)
+	srv.Close()
+	s := &spmta.WebhookSink{URL: srv.URL, Retries: 1}
+	if err := s.Send(context.Background(), b); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestWebhookOAuth2(t *testing.T) {
+	var tokensIssued int32
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_id") != "feeder" || r.Form.Get("client_secret") != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		n := atomic.AddInt32(&tokensIssued, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": fmt.Sprintf("token%d", n), "token_type": "Bearer", "expires_in": 3600})
+	}))
+	defer tokenSrv.Close()
+	var valid atomic.Value
+	valid.Store("Bearer token1")
+	mock := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != valid.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer mock.Close()
+
+	s, err := spmta.NewWebhookSink(spmta.WebhookConfig{URL: mock.URL, Backoff: "1ms",
+		Auth: &spmta.WebhookAuth{Type: "oauth2", TokenURL: tokenSrv.URL, ClientID: "feeder", ClientSecret: "s3cret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := makeBatch(t, 1)
+	for i := 0; i < 2; i++ {
+		if err = s.Send(context.Background(), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tokensIssued != 1 {
+		t.Errorf("Expected the token to be reused, got %d tokens", tokensIssued)
+	}
+	// The endpoint stops accepting the token, so a new one is fetched
+	valid.Store("Bearer token2")
+	if err = s.Send(context.Background(), b); err != nil || tokensIssued != 2 {
+		t.Errorf("Expected a new token, got %v after %d tokens", err, tokensIssued)
+	}
+
+	s.Auth.ClientSecret = "wrong"
+	valid.Store("Bearer token3")
+	if err = s.Send(context.Background(), b); err == nil || !strings.Contains(err.Error(), "oauth2 token") {
+		t.Errorf("Expected a token error, got %v", err)
+	}
+}
+
+func TestReadWebhooks(t *testing.T) {
+	sinks, err := spmta.ReadWebhooks(strings.NewReader(`[
+		{"url": "https://crm.example.com/events", "format": "msys", "auth": {"type": "basic", "username": "crm", "password": "pw"}},
+		{"url": "https://hooks.example.com/x", "retries": 0, "backoff": "5s", "max_backoff": "30s", "hmac_key": "k"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sinks) != 2 || sinks[0].Format != "msys" || sinks[0].Retries != spmta.WebhookDefaultRetries || sinks[1].Format != "msys" ||
+		sinks[1].Retries != 0 || sinks[1].Backoff.Seconds() != 5 || sinks[1].MaxBackoff.Seconds() != 30 {
+		t.Errorf("Unexpected sinks %+v %+v", sinks[0], sinks[1])
+	}
+
+	for _, bad := range []string{
+		`[]`,
+		`{"url": "https://crm.example.com/events"}`,
+		`[{"url": "not a url"}]`,
+		`[{"url": "https://crm.example.com/events", "format": "xml"}]`,
+		`[{"url": "https://crm.example.com/events", "auth": {"type": "digest"}}]`,
+		`[{"url": "https://crm.example.com/events", "auth": {"type": "basic"}}]`,
+		`[{"url": "https://crm.example.com/events", "auth": {"type": "oauth2", "client_id": "x"}}]`,
+		`[{"url": "https://crm.example.com/events", "retries": -1}]`,
+		`[{"url": "https://crm.example.com/events", "backoff": "soon"}]`,
+		`[{"url": "https://crm.example.com/events", "max_backoff": "later"}]`,
+	} {
+		if _, err := spmta.ReadWebhooks(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected an error from %s", bad)
+		}
+	}
+	if _, err := spmta.LoadWebhooks("testdata/nonexistent.json"); err == nil {
+		t.Error("Expected an error")
+	}
+	if sinks, err = spmta.LoadWebhooks("etc/feeder/webhooks.example.json"); err != nil || len(sinks) != 2 {
+		t.Errorf("Example webhooks file: %v", err)
+	}
+}
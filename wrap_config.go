@@ -0,0 +1,76 @@
+package sparkypmtatracking
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// WrapperConfig holds the wrapper settings that can be changed while the proxy is running
+type WrapperConfig struct {
+	TrackingURL      string `json:"tracking_url"`
+	TrackOpen        bool   `json:"track_open"`
+	TrackInitialOpen bool   `json:"track_initial_open"`
+	TrackLink        bool   `json:"track_click"`
+	SigningKey       string `json:"signing_key"`
+	ShortLinks       bool   `json:"short_links"`
+	LinkKeysFile     string `json:"link_keys"`
+	LinkParams       string `json:"link_params"`
+	Verbose          bool   `json:"verbose"`
+	PolicyFile       string `json:"policy"`
+}
+
+// LoadWrapperConfig returns a copy of base, with any settings present in the JSON file overriding those in base.
+// Typically base holds the command-line flag values.
+func LoadWrapperConfig(base WrapperConfig, filename string) (WrapperConfig, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return base, err
+	}
+	defer f.Close()
+	c := base
+	if err = json.NewDecoder(f).Decode(&c); err != nil {
+		return base, err
+	}
+	return c, nil
+}
+
+// ApplyConfig builds the wrapper and policy from c, then swaps them into the backend together with the verbose setting.
+// Sessions already in progress carry on safely. If there is an error, the backend is left unchanged.
+func (bkd *Backend) ApplyConfig(c WrapperConfig) error {
+	wrap, err := NewWrapper(c.TrackingURL, c.TrackOpen, c.TrackInitialOpen, c.TrackLink)
+	if err != nil && !errors.Is(err, ErrNoTrackingURL) {
+		return err
+	}
+	wrap.SetSigningKey(c.SigningKey)
+	if err = wrap.SetLinkParams(c.LinkParams); err != nil {
+		return err
+	}
+	if c.ShortLinks {
+		if bkd.links == nil {
+			return errors.New("short_links needs a link store")
+		}
+		wrap.SetLinkStore(bkd.links)
+	}
+	var keys *LinkKeys
+	if c.LinkKeysFile != "" {
+		if keys, err = LoadLinkKeys(c.LinkKeysFile); err != nil {
+			return err
+		}
+		wrap.SetLinkKeys(keys)
+	}
+	var policy *Policy
+	if c.PolicyFile != "" {
+		if policy, err = LoadPolicy(c.PolicyFile); err != nil {
+			return err
+		}
+		if err = policy.setLinkStore(bkd.links); err != nil {
+			return err
+		}
+		policy.setLinkKeys(keys)
+	}
+	bkd.SetWrapper(wrap)
+	bkd.SetPolicy(policy)
+	bkd.SetVerbose(c.Verbose)
+	return nil
+}
@@ -0,0 +1,153 @@
+package sparkypmtatracking_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	spmta "github.com/tuck1s/sparkypmtatracking"
+)
+
+// writeTempFile returns the name of a temporary file holding content. The caller should remove it.
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile(".", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadWrapperConfig(t *testing.T) {
+	base := spmta.WrapperConfig{
+		TrackingURL: "https://flags.example.com",
+		TrackOpen:   true,
+	}
+	fname := writeTempFile(t, `{"tracking_url": "https://file.example.com", "track_click": true, "verbose": true}`)
+	defer os.Remove(fname)
+	c, err := spmta.LoadWrapperConfig(base, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Values in the file override; values absent from the file are kept from base
+	expected := spmta.WrapperConfig{
+		TrackingURL: "https://file.example.com",
+		TrackOpen:   true,
+		TrackLink:   true,
+		Verbose:     true,
+	}
+	if c != expected {
+		t.Errorf("Got %+v, expected %+v", c, expected)
+	}
+
+	// Faulty inputs return base unchanged
+	if c, err = spmta.LoadWrapperConfig(base, "this_file_does_not_exist.json"); err == nil || c != base {
+		t.Errorf("Expected error and base config, got %+v %v", c, err)
+	}
+	badName := writeTempFile(t, `{"tracking_url": `)
+	defer os.Remove(badName)
+	if c, err = spmta.LoadWrapperConfig(base, badName); err == nil || c != base {
+		t.Errorf("Expected error and base config, got %+v %v", c, err)
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	be := spmta.NewBackend(":9988", false, nil, nil, true)
+	err := be.ApplyConfig(spmta.WrapperConfig{TrackingURL: "https://track.example.com", TrackOpen: true, Verbose: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if be.Wrapper().URL.String() != "https://track.example.com" || !be.Verbose() || be.Policy() != nil {
+		t.Errorf("Backend settings not applied")
+	}
+	// Blank tracking URL turns tracking off
+	if err = be.ApplyConfig(spmta.WrapperConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if be.Wrapper().Active() || be.Verbose() {
+		t.Errorf("Backend settings not applied")
+	}
+	if _, err = spmta.NewWrapper("", true, true, true); !errors.Is(err, spmta.ErrNoTrackingURL) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	// Faulty settings leave the backend unchanged
+	be.ApplyConfig(spmta.WrapperConfig{TrackingURL: "https://track.example.com"})
+	for _, c := range []spmta.WrapperConfig{
+		{TrackingURL: "example.com"},
+		{TrackingURL: "https://example.com", LinkParams: "utm_campaign={{.NoSuchField}}"},
+		{TrackingURL: "https://example.com", PolicyFile: "this_file_does_not_exist.json"},
+		{TrackingURL: "https://example.com", ShortLinks: true}, // no link store
+	} {
+		if err = be.ApplyConfig(c); err == nil {
+			t.Errorf("Expected error from %+v", c)
+		}
+		if be.Wrapper().URL.String() != "https://track.example.com" {
+			t.Errorf("Backend changed by faulty config %+v", c)
+		}
+	}
+}
+
+func TestApplyConfigShortLinks(t *testing.T) {
+	be := spmta.NewBackend(":9988", false, nil, nil, true)
+	be.SetLinkStore(spmta.NewMemoryLinkStore())
+	policyName := writeTempFile(t, `{"rules": [{"auth_user": "x", "tracking_url": "https://policy.example.com", "track_click": true, "short_links": true}]}`)
+	defer os.Remove(policyName)
+	err := be.ApplyConfig(spmta.WrapperConfig{TrackingURL: "https://track.example.com", TrackLink: true, ShortLinks: true, PolicyFile: policyName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link := be.Wrapper().WrapURL("https://example.com/"); !strings.HasPrefix(link, "https://track.example.com/s/") {
+		t.Errorf("Expected short link, got %s", link)
+	}
+	w, _ := be.Policy().Match("x", "", "")
+	if link := w.WrapURL("https://example.com/"); !strings.HasPrefix(link, "https://policy.example.com/s/") {
+		t.Errorf("Expected short link from policy, got %s", link)
+	}
+}
+
+// Swap the configuration while messages are being wrapped. Run with "go test -race" to check for data races.
+func TestBackendConfigHotSwap(t *testing.T) {
+	be := spmta.NewBackend(":9988", false, nil, nil, true)
+	policyName := writeTempFile(t, `{"rules": [{"auth_user": "x", "tracking_url": "https://policy.example.com"}]}`)
+	defer os.Remove(policyName)
+	configs := []spmta.WrapperConfig{
+		{TrackingURL: "https://one.example.com", TrackOpen: true, TrackLink: true},
+		{TrackingURL: "https://two.example.com", TrackInitialOpen: true, Verbose: true, PolicyFile: policyName},
+		{},
+	}
+	const loops = 200
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < loops; i++ {
+			if err := be.ApplyConfig(configs[i%len(configs)]); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < loops/10; i++ {
+				var buf bytes.Buffer
+				if err := be.Wrapper().MailCopy(&buf, strings.NewReader(RandomTestEmail())); err != nil {
+					t.Error(err)
+				}
+				be.Policy().Match("x", "", "")
+				_ = be.Verbose()
+			}
+		}()
+	}
+	wg.Wait()
+}
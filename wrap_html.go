@@ -3,11 +3,14 @@ package sparkypmtatracking
 import (
 	"bytes"
 	"compress/zlib"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/url"
 	"path"
 	"strings"
@@ -54,19 +57,27 @@ type Wrapper struct {
 	trackOpen        bool
 	trackInitialOpen bool
 	trackLink        bool
-	messageID        string // This info is set up per message
-	rcptTo           string // and per recipient
+	signingKey       []byte      // If set, links are signed so the tracker can check them
+	links            LinkStore   // If set, short links are made, with the link data kept in the store
+	keys             *LinkKeys   // If set, link data is encrypted
+	linkParams       []linkParam // Query parameters added to target links
+	messageID        string      // This info is set up per message
+	rcptTo           string      // and per recipient
+	campaign         string      // and campaign, if known
 }
 
+// ErrNoTrackingURL is returned by NewWrapper when the tracking URL is blank, meaning tracking is turned off
+var ErrNoTrackingURL = errors.New("No tracking URL")
+
 // NewWrapper returns a tracker with the persistent info set up from params
 func NewWrapper(URL string, trackOpen, trackInitialOpen, trackLink bool) (*Wrapper, error) {
 	u, err := url.ParseRequestURI(URL)
 	if err != nil {
+		if URL == "" {
+			return nil, fmt.Errorf("%w: %v", ErrNoTrackingURL, err)
+		}
 		return nil, err
 	}
-	if u.RawQuery != "" {
-		return nil, errors.New("Can't have query parameters in the tracking URL")
-	}
 	trk := Wrapper{
 		URL:              *u,
 		trackOpen:        trackOpen,
@@ -76,6 +87,27 @@ func NewWrapper(URL string, trackOpen, trackInitialOpen, trackLink bool) (*Wrapp
 	return &trk, nil
 }
 
+// SetSigningKey sets the key used to sign links. Blank key means links are not signed.
+func (wrap *Wrapper) SetSigningKey(key string) {
+	if wrap != nil {
+		wrap.signingKey = []byte(key)
+	}
+}
+
+// SetLinkStore makes the wrapper produce short links, keeping the link data in store. Nil store means full links are made.
+func (wrap *Wrapper) SetLinkStore(store LinkStore) {
+	if wrap != nil {
+		wrap.links = store
+	}
+}
+
+// SetLinkKeys makes the wrapper encrypt link data with keys. Nil keys means link data is not encrypted.
+func (wrap *Wrapper) SetLinkKeys(keys *LinkKeys) {
+	if wrap != nil {
+		wrap.keys = keys
+	}
+}
+
 // SetMessageInfo sets the per-message specifics
 func (wrap *Wrapper) SetMessageInfo(msgID string, rcpt string) {
 	if wrap != nil {
@@ -84,6 +116,15 @@ func (wrap *Wrapper) SetMessageInfo(msgID string, rcpt string) {
 	}
 }
 
+// copy returns a duplicate of the wrapper, so the per-message info can be set independently
+func (wrap *Wrapper) copy() *Wrapper {
+	if wrap == nil {
+		return nil
+	}
+	w := *wrap
+	return &w
+}
+
 // Active returns bool when wrapping/tracking is active.
 func (wrap *Wrapper) Active() bool {
 	return wrap != nil
@@ -96,13 +137,18 @@ func EncodeLink(encodeTrackingURL, encodeAction, encodeMessageID, encodeRcptTo,
 		return "", err
 	}
 	w.SetMessageInfo(encodeMessageID, encodeRcptTo)
-	switch encodeAction {
+	return w.Link(encodeAction, encodeTargetLinkURL)
+}
+
+// Link returns the tracking link for an action (open, initial_open or click), using the wrapper's current settings
+func (wrap *Wrapper) Link(action, targetLinkURL string) (string, error) {
+	switch action {
 	case "open":
-		return w.wrap("o", ""), nil
+		return wrap.wrap("o", ""), nil
 	case "initial_open":
-		return w.wrap("i", ""), nil
+		return wrap.wrap("i", ""), nil
 	case "click":
-		return w.WrapURL(encodeTargetLinkURL), nil
+		return wrap.WrapURL(targetLinkURL), nil
 	}
 	return "", errors.New("Invalid encodeAction")
 }
@@ -134,69 +180,132 @@ func (wrap *Wrapper) OpenPixel() string {
 // If there are problems, the original unwrapped url is returned.
 func (wrap *Wrapper) WrapURL(url string) string {
 	if wrap.URL.String() != "" && wrap.trackLink {
-		return wrap.wrap("c", url)
+		return wrap.wrap("c", wrap.addLinkParams(url))
 	}
 	return url
 }
 
 func (wrap *Wrapper) wrap(action string, targetlink string) string {
-	pathData, err := json.Marshal(
-		WrapperData{
-			Action:        action,
-			TargetLinkURL: targetlink,
-			MessageID:     wrap.messageID,
-			RcptTo:        wrap.rcptTo,
-		})
-	if err != nil {
-		return targetlink // if can't wrap, return unchanged
+	wd := WrapperData{
+		Action:        action,
+		TargetLinkURL: targetlink,
+		MessageID:     wrap.messageID,
+		RcptTo:        wrap.rcptTo,
 	}
-	b64s, err := EncodePath(pathData)
+	pathData, err := json.Marshal(wd)
 	if err != nil {
 		return targetlink // if can't wrap, return unchanged
 	}
-	pj := path.Join(wrap.URL.Path, b64s)
+	var pj string
+	if wrap.links != nil {
+		id := linkID(pathData)
+		if err = wrap.links.SaveLink(id, wd); err == nil {
+			pj = path.Join(wrap.URL.Path, ShortLinkPrefix, wrap.sign(id))
+		} else {
+			slog.Warn("Link store error, making full link", "message_id", wrap.messageID, "error", err)
+		}
+	}
+	if pj == "" && wrap.keys != nil {
+		b64s, err := wrap.keys.EncryptPath(pathData)
+		if err != nil {
+			return targetlink // if can't wrap, return unchanged
+		}
+		pj = path.Join(wrap.URL.Path, EncryptedLinkPrefix, wrap.sign(b64s))
+	}
+	if pj == "" {
+		b64s, err := EncodePath(pathData)
+		if err != nil {
+			return targetlink // if can't wrap, return unchanged
+		}
+		pj = path.Join(wrap.URL.Path, FullLinkPrefix, wrap.sign(b64s))
+	}
 	u := url.URL{ // make a local copy so we don't change the parent
-		Scheme: wrap.URL.Scheme,
-		Host:   wrap.URL.Host,
-		Path:   pj,
+		Scheme:   wrap.URL.Scheme,
+		Host:     wrap.URL.Host,
+		Path:     pj,
+		RawQuery: wrap.URL.RawQuery,
 	}
 	return u.String()
 }
 
+// sign returns link path p with a signature appended, if the wrapper has a signing key
+func (wrap *Wrapper) sign(p string) string {
+	if len(wrap.signingKey) > 0 {
+		return SignPath(p, wrap.signingKey)
+	}
+	return p
+}
+
 // EncodePath returns the base64-encoded, zlib-encoded version of data as a URL path string
 func EncodePath(data []byte) (string, error) {
+	zData, err := zlibCompress(data)
+	if err != nil {
+		return "", err
+	}
+	b64s := base64.URLEncoding.EncodeToString(zData)
+	return b64s, nil
+}
+
+func zlibCompress(data []byte) ([]byte, error) {
 	var zBuf bytes.Buffer
 	zw := zlib.NewWriter(&zBuf)
 	if _, err := zw.Write(data); err != nil {
-		return "", err
+		return nil, err
 	}
 	// Meed to close the writer to push output through
 	if err := zw.Close(); err != nil {
-		return "", err
+		return nil, err
 	}
-	b64s := base64.URLEncoding.EncodeToString(zBuf.Bytes())
-	return b64s, nil
+	return zBuf.Bytes(), nil
 }
 
-// DecodeLink - convenience function. returns JSON intermediate form, decoded Wrapper data, and tracking domain
-func DecodeLink(urlStr string) ([]byte, WrapperData, string, error) {
-	var wd WrapperData
-	url, err := url.Parse(urlStr)
-	if err != nil {
-		return nil, wd, "", err
+// SignPath appends a signature to link path p, made with key. The separator is not in the base64 URL-safe alphabet.
+func SignPath(p string, key []byte) string {
+	return p + "." + pathSignature(p, key)
+}
+
+// VerifyPath checks the signature on link path p made by SignPath, and returns p without the signature
+func VerifyPath(p string, key []byte) (string, error) {
+	unsigned, sig := splitSignature(p)
+	if sig == "" {
+		return "", errors.New("Link is not signed")
+	}
+	if !hmac.Equal([]byte(sig), []byte(pathSignature(unsigned, key))) {
+		return "", errors.New("Link signature is invalid")
 	}
-	decodeTrackingDomain := url.Scheme + "://" + url.Host
+	return unsigned, nil
+}
+
+func pathSignature(p string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(p))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
 
-	path := strings.Split(url.Path, "/") // should be only one / separator
-	if len(path) != 2 || path[0] != "" {
-		return nil, wd, decodeTrackingDomain, errors.New("Invalid link path")
+// splitSignature returns link path p and its signature separately. The signature is blank if not present.
+func splitSignature(p string) (string, string) {
+	i := strings.LastIndex(p, ".")
+	if i < 0 {
+		return p, ""
 	}
-	eBytes, err := DecodePath(path[1])
+	return p[:i], p[i+1:]
+}
+
+// VerifyLink checks the signature on a tracking link URL, made with key
+func VerifyLink(urlStr string, key []byte) error {
+	u, err := url.Parse(urlStr)
 	if err != nil {
-		return eBytes, wd, decodeTrackingDomain, err
+		return err
 	}
-	err = json.Unmarshal(eBytes, &wd)
-	return eBytes, wd, decodeTrackingDomain, err
+	_, p := splitLinkPrefix(u.Path)
+	_, err = VerifyPath(p, key)
+	return err
+}
+
+// DecodeLink - convenience function. returns JSON intermediate form, decoded Wrapper data, and tracking domain.
+// Links of any format that carries the link data are decoded; use ResolveLink for short and encrypted links.
+func DecodeLink(urlStr string) ([]byte, WrapperData, string, error) {
+	return ResolveLink(urlStr, nil, nil)
 }
 
 // DecodePath returns the zlib-decoded, base64-decoded version of a url path string as []byte
@@ -205,6 +314,10 @@ func DecodePath(s string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return zlibDecompress(zData)
+}
+
+func zlibDecompress(zData []byte) ([]byte, error) {
 	zr, err := zlib.NewReader(bytes.NewReader(zData))
 	if err != nil {
 		return nil, err
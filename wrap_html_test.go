@@ -291,9 +291,13 @@ func TestNewWrapper(t *testing.T) {
 		t.Errorf("Faulty input test should have failed")
 	}
 
-	_, err = spmta.NewWrapper("https://example.com/?pet=dog", true, true, true)
-	if err == nil {
-		t.Errorf("Faulty input test should have failed")
+	// Query parameters on the tracking URL are kept in the links
+	w, err := spmta.NewWrapper("https://example.com/?pet=dog", true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link := w.WrapURL("https://example.org/"); !strings.HasSuffix(link, "?pet=dog") {
+		t.Errorf("Link %s lost the tracking URL query", link)
 	}
 }
 
@@ -404,10 +408,9 @@ func TestEncodeDecodeLinkFaultyInputs(t *testing.T) {
 
 	// faulty inputs to EecodeLink
 	eList := [][]string{
-		{"Invalid encodeAction", trkDomain, "pigs"},                              // invalid action
-		{"empty url", "", "click"},                                               // blank tracking domain
-		{"invalid URI", "notaurl", "click"},                                      // invalid tracking domain
-		{"Can't have query parameters", "https://example.com?pets=dog", "click"}, // got query parameter
+		{"Invalid encodeAction", trkDomain, "pigs"}, // invalid action
+		{"empty url", "", "click"},                  // blank tracking domain
+		{"invalid URI", "notaurl", "click"},         // invalid tracking domain
 	}
 	for _, e := range eList {
 		url, err := spmta.EncodeLink(e[1], e[2], msgID, recip, link, true, true, true)
@@ -438,6 +441,47 @@ func TestEncodeDecodeLinkFaultyInputs(t *testing.T) {
 	}
 }
 
+func TestSignVerifyLink(t *testing.T) {
+	key := []byte("a secret key")
+	w, err := spmta.NewWrapper(RandomBaseURL(), true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetSigningKey(string(key))
+	msgID := spmta.UniqMessageID()
+	recip := RandomRecipient()
+	w.SetMessageInfo(msgID, recip)
+	target := RandomURLWithPath()
+	link := w.WrapURL(target)
+	if err = spmta.VerifyLink(link, key); err != nil {
+		t.Error(err)
+	}
+	if err = spmta.VerifyLink(link, []byte("wrong key")); err == nil || !strings.Contains(err.Error(), "signature is invalid") {
+		t.Errorf("Expected invalid signature, got %v", err)
+	}
+	// Signed links still decode
+	_, wd, _, err := spmta.DecodeLink(link)
+	if err != nil || wd.TargetLinkURL != target || wd.MessageID != msgID || wd.RcptTo != recip {
+		t.Errorf("Signed link decoded unexpected value %v %v", wd, err)
+	}
+	// Unsigned links fail verification
+	unsigned, err := spmta.EncodeLink(RandomBaseURL(), "click", msgID, recip, target, true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = spmta.VerifyLink(unsigned, key); err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Errorf("Expected not signed, got %v", err)
+	}
+	if err = spmta.VerifyLink("\n", key); err == nil {
+		t.Errorf("Expected error from invalid URL")
+	}
+	// Path level
+	p := spmta.SignPath("abc", key)
+	if got, err := spmta.VerifyPath(p, key); err != nil || got != "abc" {
+		t.Errorf("VerifyPath returned %s, %v", got, err)
+	}
+}
+
 // Test functions that are usually called back by the smtpproxy
 func TestWrapperActive(t *testing.T) {
 	// start with nil value, should return false
@@ -2,81 +2,196 @@ package sparkypmtatracking
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"mime"
 	"mime/multipart"
 	"net"
 	"net/mail"
+	"net/textproto"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
 	smtpproxy "github.com/tuck1s/go-smtpproxy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //-----------------------------------------------------------------------------
 // Backend handlers
 
 // The Backend implements SMTP server methods.
+// The wrapper, policy and verbose settings can be swapped while sessions are running, so are held atomically.
 type Backend struct {
 	outHostPort        string
-	verbose            bool
+	verbose            atomic.Bool
 	upstreamDataDebug  *os.File
-	wrapper            *Wrapper
+	wrapper            atomic.Pointer[Wrapper]
+	policy             atomic.Pointer[Policy]
 	insecureSkipVerify bool
+	links              LinkStore     // used by wrappers making short links
+	draining           atomic.Bool   // set when shutting down - no new sessions or messages accepted
+	readTimeout        time.Duration // the server's read timeout; sessions quiet for longer have been closed
+	mu                 sync.Mutex
+	messages           map[*Session]time.Time // sessions with a message in progress, and when each was last active
 }
 
+// DefaultReadTimeout is the server read timeout the backend assumes, unless told otherwise with SetReadTimeout
+const DefaultReadTimeout = 60 * time.Second
+
 // NewBackend init function
 func NewBackend(outHostPort string, verbose bool, upstreamDataDebug *os.File, wrap *Wrapper, insecureSkipVerify bool) *Backend {
 	b := Backend{
 		outHostPort:        outHostPort,
-		verbose:            verbose,
 		upstreamDataDebug:  upstreamDataDebug,
-		wrapper:            wrap,
 		insecureSkipVerify: insecureSkipVerify,
+		readTimeout:        DefaultReadTimeout,
+		messages:           make(map[*Session]time.Time),
 	}
+	b.verbose.Store(verbose)
+	b.wrapper.Store(wrap)
 	return &b
 }
 
+// SetLinkStore sets the store used for short links. Call before ApplyConfig.
+func (bkd *Backend) SetLinkStore(store LinkStore) {
+	bkd.links = store
+}
+
+// SetReadTimeout tells the backend the server's read timeout. Call before serving.
+func (bkd *Backend) SetReadTimeout(d time.Duration) {
+	bkd.readTimeout = d
+}
+
 // SetVerbose allows changing logging options on-the-fly
 func (bkd *Backend) SetVerbose(v bool) {
-	bkd.verbose = v
+	bkd.verbose.Store(v)
+}
+
+// Verbose returns the current logging option
+func (bkd *Backend) Verbose() bool {
+	return bkd.verbose.Load()
 }
 
 // SetWrapper Verbose allows changing on-the-fly
 func (bkd *Backend) SetWrapper(wrap *Wrapper) {
-	bkd.wrapper = wrap
+	bkd.wrapper.Store(wrap)
+}
+
+// Wrapper returns the current default wrapper
+func (bkd *Backend) Wrapper() *Wrapper {
+	return bkd.wrapper.Load()
+}
+
+// SetPolicy allows changing the per-sender tracking policy on-the-fly. nil means all messages use the default wrapper.
+func (bkd *Backend) SetPolicy(p *Policy) {
+	bkd.policy.Store(p)
+}
+
+// Policy returns the current per-sender tracking policy
+func (bkd *Backend) Policy() *Policy {
+	return bkd.policy.Load()
 }
 
 func (bkd *Backend) logger(args ...interface{}) {
-	if bkd.verbose {
-		log.Println(args...)
+	if bkd.Verbose() {
+		slog.Info(logMsg(args...))
 	}
 }
 
 func (bkd *Backend) loggerAlways(args ...interface{}) {
-	log.Println(args...)
+	slog.Warn(logMsg(args...))
+}
+
+// Drain stops new sessions and messages being accepted, then waits up to timeout for the messages in progress to
+// complete. A message is in progress from MAIL FROM until it is relayed, or the session is reset or ends. Sessions
+// quiet for longer than the read timeout have been closed by the server, so are not waited for.
+// Returns true if all messages completed.
+func (bkd *Backend) Drain(timeout time.Duration) bool {
+	bkd.draining.Store(true)
+	deadline := time.Now().Add(timeout)
+	for bkd.inProgress() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// begin marks s as having a message in progress
+func (bkd *Backend) begin(s *Session) {
+	bkd.mu.Lock()
+	defer bkd.mu.Unlock()
+	bkd.messages[s] = time.Now()
 }
 
+// touch records activity on the message in progress of s, if any
+func (bkd *Backend) touch(s *Session) {
+	bkd.mu.Lock()
+	defer bkd.mu.Unlock()
+	if _, found := bkd.messages[s]; found {
+		bkd.messages[s] = time.Now()
+	}
+}
+
+// end marks s as having no message in progress
+func (bkd *Backend) end(s *Session) {
+	bkd.mu.Lock()
+	defer bkd.mu.Unlock()
+	delete(bkd.messages, s)
+}
+
+// inProgress returns the number of messages in progress, forgetting those of sessions the server has closed
+func (bkd *Backend) inProgress() int {
+	bkd.mu.Lock()
+	defer bkd.mu.Unlock()
+	for s, last := range bkd.messages {
+		if time.Since(last) > bkd.readTimeout {
+			delete(bkd.messages, s)
+		}
+	}
+	return len(bkd.messages)
+}
+
+// errShuttingDown is returned for new sessions and messages once the backend is draining
+var errShuttingDown = errors.New("Proxy is shutting down")
+
 // MakeSession returns a session for this client and backend
 func MakeSession(c *smtpproxy.Client, bkd *Backend) smtpproxy.Session {
 	var s Session
 	s.bkd = bkd    // just for logging
 	s.upstream = c // keep record of the upstream Client connection
+	s.id = uuid.New().String()
+	s.ctx, s.span = tracer.Start(context.Background(), "smtp.session", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("session", s.id), attribute.String("smtp.upstream", bkd.outHostPort)))
 	return &s
 }
 
 // Init the backend. Here we establish the upstream connection
 func (bkd *Backend) Init() (smtpproxy.Session, error) {
+	if bkd.draining.Load() {
+		WrapperSessions.WithLabelValues("shutting_down").Inc()
+		return nil, errShuttingDown
+	}
 	bkd.logger("---Connecting upstream")
 	c, err := smtpproxy.Dial(bkd.outHostPort)
 	if err != nil {
+		WrapperSessions.WithLabelValues("upstream_error").Inc()
 		bkd.loggerAlways("< Connection error", bkd.outHostPort, err.Error())
 		return nil, err
 	}
+	WrapperSessions.WithLabelValues("ok").Inc()
 	bkd.logger("< Connection success", bkd.outHostPort)
 	return MakeSession(c, bkd), nil
 }
@@ -88,6 +203,34 @@ func (bkd *Backend) Init() (smtpproxy.Session, error) {
 type Session struct {
 	bkd      *Backend          // The backend that created this session. Allows session methods to e.g. log
 	upstream *smtpproxy.Client // the upstream client this backend is driving
+	id       string            // identifies this session in logs
+	ctx      context.Context   // carries the session trace span
+	span     trace.Span        // session trace span, ended at QUIT
+	dataSpan trace.Span        // trace span of the message in the DATA phase, if any
+	authMech string            // AUTH mechanism in progress, used to pick out the username
+	authUser string            // SMTP AUTH username, if seen
+	mailFrom string            // MAIL FROM address of the current message
+}
+
+// logger logs the SMTP conversation, if the backend is verbose
+func (s *Session) logger(args ...interface{}) {
+	if s.bkd.Verbose() {
+		slog.Info(logMsg(args...), "session", s.id)
+	}
+}
+
+// loggerAlways logs errors in the SMTP conversation
+func (s *Session) loggerAlways(args ...interface{}) {
+	slog.Warn(logMsg(args...), "session", s.id)
+}
+
+// command runs f, which sends an SMTP command upstream, in a trace span named for the command
+func (s *Session) command(name string, f func() (int, string, error)) (int, string, error) {
+	_, span := tracer.Start(s.ctx, "smtp "+name, trace.WithSpanKind(trace.SpanKindClient))
+	code, msg, err := f()
+	span.SetAttributes(attribute.Int("smtp.code", code))
+	endSpan(span, err)
+	return code, msg, err
 }
 
 // cmdTwiddle returns different flow markers depending on whether connection is secure (like Swaks does)
@@ -112,14 +255,23 @@ func respTwiddle(s *Session) string {
 
 // Greet the upstream host and report capabilities back.
 func (s *Session) Greet(helotype string) ([]string, int, string, error) {
-	s.bkd.logger(cmdTwiddle(s), helotype)
+	var caps []string
+	code, msg, err := s.command(helotype, func() (code int, msg string, err error) {
+		caps, code, msg, err = s.greet(helotype)
+		return code, msg, err
+	})
+	return caps, code, msg, err
+}
+
+func (s *Session) greet(helotype string) ([]string, int, string, error) {
+	s.logger(cmdTwiddle(s), helotype)
 	host, _, _ := net.SplitHostPort(s.bkd.outHostPort)
 	if host == "" {
 		host = "smtpproxy.localhost" // add dummy value in
 	}
 	code, msg, err := s.upstream.Hello(host)
 	if err != nil {
-		s.bkd.loggerAlways(respTwiddle(s), helotype, "error", err.Error())
+		s.loggerAlways(respTwiddle(s), helotype, "error", err.Error())
 		if code == 0 {
 			// some errors don't show up in (code,msg) e.g. TLS cert errors, so map as a specific SMTP code/msg response
 			code = 599
@@ -127,9 +279,9 @@ func (s *Session) Greet(helotype string) ([]string, int, string, error) {
 		}
 		return nil, code, msg, err
 	}
-	s.bkd.logger(respTwiddle(s), helotype, "success")
+	s.logger(respTwiddle(s), helotype, "success")
 	caps := s.upstream.Capabilities()
-	s.bkd.logger("\tUpstream capabilities:", caps)
+	s.logger("\tUpstream capabilities:", caps)
 	return caps, code, msg, err
 }
 
@@ -141,91 +293,211 @@ func (s *Session) StartTLS() (int, string, error) {
 		InsecureSkipVerify: s.bkd.insecureSkipVerify,
 		ServerName:         host,
 	}
-	s.bkd.logger(cmdTwiddle(s), "STARTTLS")
-	code, msg, err := s.upstream.StartTLS(tlsconfig)
+	s.logger(cmdTwiddle(s), "STARTTLS")
+	code, msg, err := s.command("STARTTLS", func() (int, string, error) {
+		return s.upstream.StartTLS(tlsconfig)
+	})
 	if err != nil {
-		s.bkd.loggerAlways(respTwiddle(s), code, msg)
+		s.loggerAlways(respTwiddle(s), code, msg)
 	} else {
-		s.bkd.logger(respTwiddle(s), code, msg)
+		s.logger(respTwiddle(s), code, msg)
 	}
 	return code, msg, err
 }
 
 //Auth command backend handler
 func (s *Session) Auth(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+	s.noteAuth(cmd, arg)
+	return s.command("AUTH", func() (int, string, error) { return s.Passthru(expectcode, cmd, arg) })
+}
+
+// noteAuth picks out the username from AUTH PLAIN and AUTH LOGIN exchanges, for use in the tracking policy.
+// Continuation lines from the client arrive as cmd, with empty arg.
+func (s *Session) noteAuth(cmd, arg string) {
+	var resp string
+	if strings.EqualFold(cmd, "AUTH") {
+		f := strings.Fields(arg)
+		if len(f) == 0 {
+			return
+		}
+		s.authMech = strings.ToUpper(f[0])
+		if len(f) < 2 {
+			return // credentials will follow on a continuation line
+		}
+		resp = f[1]
+	} else {
+		resp = cmd
+	}
+	b, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		return
+	}
+	switch s.authMech {
+	case "PLAIN":
+		// authzid NUL authcid NUL passwd
+		if p := strings.Split(string(b), "\x00"); len(p) == 3 {
+			s.authUser = p[1]
+		}
+	case "LOGIN":
+		s.authUser = string(b) // first response is the username
+	}
+	s.authMech = "" // done; ignore further lines such as the password
 }
 
 //Mail command backend handler
 func (s *Session) Mail(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+	if s.bkd.draining.Load() {
+		s.loggerAlways(respTwiddle(s), "MAIL refused", errShuttingDown.Error())
+		return 421, "4.3.2 " + errShuttingDown.Error(), errShuttingDown
+	}
+	if addr, err := mailFromAddress(arg); err == nil {
+		s.mailFrom = addr
+	}
+	s.bkd.begin(s)
+	code, msg, err := s.command("MAIL", func() (int, string, error) { return s.Passthru(expectcode, cmd, arg) })
+	if err != nil {
+		s.bkd.end(s)
+	}
+	return code, msg, err
 }
 
 //Rcpt command backend handler
 func (s *Session) Rcpt(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+	s.bkd.touch(s)
+	return s.command("RCPT", func() (int, string, error) { return s.Passthru(expectcode, cmd, arg) })
 }
 
 //Reset command backend handler
 func (s *Session) Reset(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+	s.mailFrom = ""
+	s.bkd.end(s)
+	return s.command("RSET", func() (int, string, error) { return s.Passthru(expectcode, cmd, arg) })
 }
 
 //Quit command backend handler
 func (s *Session) Quit(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+	defer s.span.End()
+	s.bkd.end(s)
+	return s.command("QUIT", func() (int, string, error) { return s.Passthru(expectcode, cmd, arg) })
 }
 
 //Unknown command backend handler
 func (s *Session) Unknown(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+	return s.command("UNKNOWN", func() (int, string, error) { return s.Passthru(expectcode, cmd, arg) })
 }
 
 // Passthru a command to the upstream server, logging
 func (s *Session) Passthru(expectcode int, cmd, arg string) (int, string, error) {
-	s.bkd.logger(cmdTwiddle(s), cmd, arg)
+	s.logger(cmdTwiddle(s), cmd, arg)
 	joined := cmd
 	if arg != "" {
 		joined = cmd + " " + arg
 	}
 	code, msg, err := s.upstream.MyCmd(expectcode, joined)
 	if err != nil {
-		s.bkd.loggerAlways(respTwiddle(s), cmd, code, msg, "error", err.Error())
+		s.loggerAlways(respTwiddle(s), cmd, code, msg, "error", err.Error())
 		if code == 0 {
 			// some errors don't show up in (code,msg) e.g. TLS cert errors, so map as a specific SMTP code/msg response
 			code = 599
 			msg = err.Error()
 		}
 	} else {
-		s.bkd.logger(respTwiddle(s), code, msg)
+		s.logger(respTwiddle(s), code, msg)
 	}
 	return code, msg, err
 }
 
 // DataCommand pass upstream, returning a place to write the data AND the usual responses
 func (s *Session) DataCommand() (io.WriteCloser, int, string, error) {
-	s.bkd.logger(cmdTwiddle(s), "DATA")
+	s.logger(cmdTwiddle(s), "DATA")
+	s.bkd.touch(s)
+	_, s.dataSpan = tracer.Start(s.ctx, "smtp DATA", trace.WithSpanKind(trace.SpanKindClient))
 	w, code, msg, err := s.upstream.Data()
 	if err != nil {
-		s.bkd.loggerAlways(respTwiddle(s), "DATA error", err.Error())
+		s.bkd.end(s)
+		s.endDataSpan(code, err)
+		s.loggerAlways(respTwiddle(s), "DATA error", err.Error())
 	}
 	return w, code, msg, err
 }
 
+// endDataSpan ends the trace span of the message in the DATA phase, if there is one
+func (s *Session) endDataSpan(code int, err error) {
+	if s.dataSpan != nil {
+		s.dataSpan.SetAttributes(attribute.Int("smtp.code", code))
+		endSpan(s.dataSpan, err)
+		s.dataSpan = nil
+	}
+}
+
+// activeReader reads the message body, recording activity on the session, so Drain waits for a long upload
+type activeReader struct {
+	io.Reader
+	s *Session
+}
+
+func (r activeReader) Read(p []byte) (int, error) {
+	r.s.bkd.touch(r.s)
+	return r.Reader.Read(p)
+}
+
+// messageWrapper returns the wrapper to use for this message, chosen by the backend policy if there is one.
+func (s *Session) messageWrapper(msg []byte) *Wrapper {
+	wrap := s.bkd.Wrapper()
+	if policy := s.bkd.Policy(); policy != nil {
+		from := ""
+		if m, err := mail.ReadMessage(bytes.NewReader(msg)); err == nil {
+			from = m.Header.Get("From")
+		}
+		if pw, found := policy.Match(s.authUser, s.mailFrom, from); found {
+			s.logger("\tTracking policy matched for auth user", s.authUser, "mail from", s.mailFrom, "header from", from)
+			wrap = pw
+		}
+	}
+	return wrap
+}
+
 // Data body (dot delimited) pass upstream, returning the usual responses
 func (s *Session) Data(r io.Reader, w io.WriteCloser) (int, string, error) {
-	var buf bytes.Buffer
-	err := s.bkd.wrapper.MailCopy(&buf, r) // Pass in the engagement tracking info
+	defer s.bkd.end(s)
+	code, msg, err := s.data(activeReader{Reader: r, s: s}, w)
+	s.endDataSpan(code, err)
+	if err != nil {
+		WrapperMessages.WithLabelValues("error").Inc()
+	} else {
+		WrapperMessages.WithLabelValues("ok").Inc()
+	}
+	if code != 0 {
+		WrapperUpstreamResponses.WithLabelValues(strconv.Itoa(code)).Inc()
+	}
+	return code, msg, err
+}
+
+// data wraps the message body and sends it upstream
+func (s *Session) data(r io.Reader, w io.WriteCloser) (int, string, error) {
+	var in, buf bytes.Buffer
+	if _, err := io.Copy(&in, r); err != nil {
+		msg := "DATA read error"
+		s.loggerAlways(respTwiddle(s), msg, err.Error())
+		return 0, msg, err
+	}
+	msgID, err := s.messageWrapper(in.Bytes()).mailCopy(&buf, &in) // Pass in the engagement tracking info
 	if err != nil {
 		msg := "DATA MailCopy error"
-		s.bkd.loggerAlways(respTwiddle(s), msg, err.Error())
+		slog.Warn(msg, "session", s.id, "message_id", msgID, "error", err)
 		return 0, msg, err
 	}
+	if msgID != "" {
+		s.span.AddEvent("message", trace.WithAttributes(MessageIDAttr.String(msgID)))
+		if s.dataSpan != nil {
+			s.dataSpan.SetAttributes(MessageIDAttr.String(msgID))
+		}
+	}
 	// Upstream debug output - nondestructively read buf contents
 	if s.bkd.upstreamDataDebug != nil {
 		dbgWritten, err := io.Copy(s.bkd.upstreamDataDebug, bytes.NewReader(buf.Bytes()))
 		if err != nil {
-			s.bkd.loggerAlways("upstreamDataDebug error", err, ", bytes written =", dbgWritten)
+			slog.Warn("upstreamDataDebug error", "session", s.id, "message_id", msgID, "bytes", dbgWritten, "error", err)
 			return 0, "", err
 		}
 	}
@@ -233,22 +505,18 @@ func (s *Session) Data(r io.Reader, w io.WriteCloser) (int, string, error) {
 	count, err := io.Copy(w, &buf)
 	if err != nil {
 		msg := "DATA io.Copy error"
-		s.bkd.loggerAlways(respTwiddle(s), msg, err.Error())
+		slog.Warn(msg, "session", s.id, "message_id", msgID, "error", err)
 		return 0, msg, err
 	}
 	err = w.Close() // Need to close the data phase - then we should have response from upstream
 	code := s.upstream.DataResponseCode
 	msg := s.upstream.DataResponseMsg
 	if err != nil {
-		s.bkd.loggerAlways(respTwiddle(s), "DATA Close error", err, ", bytes written =", count)
+		slog.Warn("DATA Close error", "session", s.id, "message_id", msgID, "bytes", count, "upstream_code", code, "upstream_msg", msg, "error", err)
 		return 0, msg, err
 	}
-	if s.bkd.verbose {
-		s.bkd.logger(respTwiddle(s), "DATA accepted, bytes written =", count)
-	} else {
-		// Short-form logging - one line per message - used when "verbose" not set
-		log.Printf("Message DATA upstream,%d,%d,%s\n", count, code, msg)
-	}
+	// One line per message
+	slog.Info("Message relayed", "session", s.id, "message_id", msgID, "bytes", count, "upstream_code", code, "upstream_msg", msg)
 	return code, msg, err
 }
 
@@ -260,26 +528,33 @@ const SparkPostMessageIDHeader = "X-Sp-Message-Id"
 const smtpCRLF = "\r\n"
 
 // MailCopy transfers the mail body from downstream (client) to upstream (server), using the engagement wrapper
-// The writer should be closed by the parent function
+// The writer should be closed by the parent function. The per-message info is held in a copy of the wrapper,
+// so concurrent sessions can share the same wrapper.
 func (wrap *Wrapper) MailCopy(dst io.Writer, src io.Reader) error {
+	_, err := wrap.mailCopy(dst, src)
+	return err
+}
+
+// mailCopy is MailCopy, also returning the message ID, or "" if wrapping is inactive
+func (wrap *Wrapper) mailCopy(dst io.Writer, src io.Reader) (string, error) {
 	if !wrap.Active() {
-		_, err := io.Copy(dst, src) // wrapping inactive, just do a copy
-		return err
+		return "", copyWithoutTrackingHeaders(dst, src) // wrapping inactive, just do a copy
 	}
+	wrap = wrap.copy()
 	message, err := mail.ReadMessage(src)
 	if err != nil {
-		return err
+		return "", err
 	}
 	err = wrap.ProcessMessageHeaders(message.Header)
 	if err != nil {
-		return err
+		return "", err
 	}
 	err = writeMessageHeaders(dst, message.Header)
 	if err != nil {
-		return err
+		return wrap.messageID, err
 	}
 	// Handle the message body
-	return wrap.HandleMessagePart(dst, message.Body, message.Header.Get("Content-Type"), message.Header.Get("Content-Transfer-Encoding"))
+	return wrap.messageID, wrap.HandleMessagePart(dst, message.Body, message.Header.Get("Content-Type"), message.Header.Get("Content-Transfer-Encoding"))
 }
 
 // ProcessMessageHeaders reads the message's current headers and updates/inserts any new ones required.
@@ -303,9 +578,102 @@ func (wrap *Wrapper) ProcessMessageHeaders(h mail.Header) error {
 		h[SparkPostMessageIDHeader] = []string{uniq} // Add unique value into the message headers for PowerMTA / Signals to process
 	}
 	wrap.SetMessageInfo(uniq, rcpts[0].Address)
+	wrap.applyTrackingHeaders(h)
 	return nil
 }
 
+// Per-message tracking control headers. These are removed from the message before it is relayed.
+const (
+	TrackOpensHeader        = "X-Track-Opens"
+	TrackInitialOpensHeader = "X-Track-Initial-Opens"
+	TrackClicksHeader       = "X-Track-Clicks"
+	MSYSAPIHeader           = "X-MSYS-API"
+)
+
+var trackingHeaders = []string{MSYSAPIHeader, TrackOpensHeader, TrackInitialOpensHeader, TrackClicksHeader}
+
+// msysAPI holds the parts of the SparkPost X-MSYS-API header we act on. Pointers distinguish absent from false.
+type msysAPI struct {
+	CampaignID string `json:"campaign_id"`
+	Options    struct {
+		OpenTracking  *bool `json:"open_tracking"`
+		ClickTracking *bool `json:"click_tracking"`
+		InitialOpen   *bool `json:"initial_open"`
+	} `json:"options"`
+}
+
+// applyTrackingHeaders turns tracking off (or on) for this message only, according to any control headers present,
+// and picks up the campaign, then strips those headers. The wrapper should be a per-message copy. X-Track-* headers take precedence over X-MSYS-API.
+func (wrap *Wrapper) applyTrackingHeaders(h mail.Header) {
+	if v := h.Get(MSYSAPIHeader); v != "" {
+		var api msysAPI
+		if err := json.Unmarshal([]byte(v), &api); err != nil {
+			slog.Warn("Ignoring invalid header", "header", MSYSAPIHeader, "message_id", wrap.messageID, "error", err)
+		} else {
+			setIfPresent(&wrap.trackOpen, api.Options.OpenTracking)
+			setIfPresent(&wrap.trackLink, api.Options.ClickTracking)
+			setIfPresent(&wrap.trackInitialOpen, api.Options.InitialOpen)
+			wrap.SetCampaign(api.CampaignID)
+		}
+	}
+	wrap.trackOpen = headerBool(h, TrackOpensHeader, wrap.trackOpen)
+	wrap.trackInitialOpen = headerBool(h, TrackInitialOpensHeader, wrap.trackInitialOpen)
+	wrap.trackLink = headerBool(h, TrackClicksHeader, wrap.trackLink)
+	removeTrackingHeaders(h)
+}
+
+// removeTrackingHeaders strips the tracking control headers, returning true if any were present
+func removeTrackingHeaders(h mail.Header) bool {
+	found := false
+	for _, k := range trackingHeaders {
+		k = textproto.CanonicalMIMEHeaderKey(k)
+		if _, ok := h[k]; ok {
+			delete(h, k)
+			found = true
+		}
+	}
+	return found
+}
+
+// copyWithoutTrackingHeaders copies the message unchanged, apart from stripping any tracking control headers, so
+// they are not relayed even when wrapping is inactive
+func copyWithoutTrackingHeaders(dst io.Writer, src io.Reader) error {
+	raw, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	message, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil || !removeTrackingHeaders(message.Header) {
+		_, err = dst.Write(raw) // nothing to strip, so keep the headers exactly as they were
+		return err
+	}
+	if err = writeMessageHeaders(dst, message.Header); err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, message.Body)
+	return err
+}
+
+func setIfPresent(dst *bool, v *bool) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+// headerBool returns the boolean value of header k, or default d if the header is absent or invalid
+func headerBool(h mail.Header, k string, d bool) bool {
+	v := h.Get(k)
+	if v == "" {
+		return d
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		slog.Warn("Ignoring invalid header", "header", k, "value", v)
+		return d
+	}
+	return b
+}
+
 // write m headers to dst. The m.Header map does not preserve order, but that should not matter.
 func writeMessageHeaders(dst io.Writer, h mail.Header) error {
 	for hdrType, hdrList := range h {
@@ -341,7 +709,7 @@ func (wrap *Wrapper) HandleMessagePart(dst io.Writer, part io.Reader, cType stri
 			dst = base64.NewEncoder(base64.StdEncoding, lsWriter)
 		} else {
 			if !(cte == "" || cte == "7bit" || cte == "8bit") {
-				log.Println("Warning: don't know how to handle Content-Type-Encoding", cte)
+				slog.Warn("Don't know how to handle Content-Transfer-Encoding", "message_id", wrap.messageID, "cte", cte)
 			}
 		}
 		_, err = wrap.TrackHTML(dst, part) // Wrap the links and add tracking pixels (if active)
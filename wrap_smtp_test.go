@@ -319,6 +319,16 @@ func TestWrapSMTP(t *testing.T) {
 	be.SetWrapper(nil)
 	sendAndCheckEmails(t, inHostPort, 20, "STARTTLS", mockReply, "", RandomTestEmail)
 	sendAndCheckEmails(t, inHostPort, 20, "STARTTLS", mockReply, "", NestedEmailRFC822)
+
+	// Tracking chosen per message by policy, matching the AUTH PLAIN user
+	const policyURL = "https://track.policy.example.com"
+	policy, err := spmta.ReadPolicy(strings.NewReader(`{"rules": [{"auth_user": "user@example.com", "tracking_url": "` + policyURL + `", "track_open": true}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.SetPolicy(policy)
+	sendAndCheckEmails(t, inHostPort, 20, "STARTTLS", mockReply, policyURL, RandomTestEmail)
+	be.SetPolicy(nil)
 }
 
 func sendAndCheckEmails(t *testing.T, inHostPort string, n int, secure string, mockReply chan []byte, trackingURL string, makeEmail func() string) {
@@ -616,6 +626,73 @@ func TestWrapSMTPFaultyInputs(t *testing.T) {
 	_, _, _, _ = caps, code, msg, w // workaround these variables being "unused" yet useful for debugging the test
 }
 
+func TestBackendDrain(t *testing.T) {
+	be := spmta.NewBackend(":9988", false, nil, nil, true)
+	// Nothing in flight, so should complete immediately
+	start := time.Now()
+	if !be.Drain(10 * time.Second) {
+		t.Errorf("Drain reported messages still in progress")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Drain took too long with nothing in flight")
+	}
+	// New sessions are refused once draining
+	_, err := be.Init()
+	if err == nil || !strings.Contains(err.Error(), "shutting down") {
+		t.Errorf("Expected shutting down error, got %v", err)
+	}
+}
+
+func TestBackendDrainMessages(t *testing.T) {
+	replies := map[string]string{"MAIL": "250 OK", "RSET": "250 OK"}
+	be := spmta.NewBackend(":9988", false, nil, nil, true)
+	be.SetReadTimeout(10 * time.Second)
+	s := makeFakeSession(t, be, fakeUpstream(t, replies))
+	if _, _, err := s.Mail(250, "MAIL FROM:", "<alice@example.com>"); err != nil {
+		t.Fatal(err)
+	}
+	makeFakeSession(t, be, fakeUpstream(t, replies)) // idle session with no message in progress, so not waited for
+
+	// Message in progress, so Drain waits for the session to reset
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		s.Reset(250, "RSET", "")
+	}()
+	start := time.Now()
+	if !be.Drain(10 * time.Second) {
+		t.Errorf("Drain reported messages still in progress")
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("Drain took %v, expected it to wait for the reset", elapsed)
+	}
+	// New messages are refused once draining
+	code, _, err := s.Mail(250, "MAIL FROM:", "<alice@example.com>")
+	if err == nil || code != 421 {
+		t.Errorf("Expected message to be refused, got %d %v", code, err)
+	}
+}
+
+func TestBackendDrainQuietSession(t *testing.T) {
+	be := spmta.NewBackend(":9988", false, nil, nil, true)
+	be.SetReadTimeout(500 * time.Millisecond)
+	s := makeFakeSession(t, be, fakeUpstream(t, map[string]string{"MAIL": "250 OK"}))
+	if _, _, err := s.Mail(250, "MAIL FROM:", "<alice@example.com>"); err != nil {
+		t.Fatal(err)
+	}
+	// Short timeout, client still within the read timeout
+	if be.Drain(100 * time.Millisecond) {
+		t.Errorf("Drain should have timed out with a message in progress")
+	}
+	// Client never finishes the message, so the server closes the session after the read timeout
+	start := time.Now()
+	if !be.Drain(10 * time.Second) {
+		t.Errorf("Drain should not wait for a closed session")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Drain took too long waiting for a closed session")
+	}
+}
+
 // Deliberately return a WriteCloser that should break
 func brokenWriteCloser(t *testing.T) io.WriteCloser {
 	f := alreadyClosedFile(t)
@@ -673,6 +750,105 @@ func TestProcessMessageHeadersFaultyInputs(t *testing.T) {
 	}
 }
 
+func TestProcessMessageHeadersTrackingControl(t *testing.T) {
+	trkDomain := RandomBaseURL()
+	link := RandomURLWithPath()
+	type controlCase struct {
+		hdrs                                   map[string]string
+		expectOpen, expectInitial, expectClick bool
+	}
+	cases := []controlCase{
+		{map[string]string{}, true, true, true},
+		{map[string]string{"X-Track-Opens": "false"}, false, true, true},
+		{map[string]string{"X-Track-Clicks": "0", "X-Track-Initial-Opens": "false"}, true, false, false},
+		{map[string]string{"X-Track-Opens": "banana"}, true, true, true}, // invalid values are ignored
+		{map[string]string{"X-MSYS-API": `{"options": {"open_tracking": false, "click_tracking": false}}`}, false, true, false},
+		{map[string]string{"X-MSYS-API": `{"options": {"initial_open": false}, "campaign_id": "x"}`}, true, false, true},
+		{map[string]string{"X-MSYS-API": `{"options": {"open_tracking": false}}`, "X-Track-Opens": "true"}, true, true, true},
+		{map[string]string{"X-MSYS-API": `{"options": `}, true, true, true}, // invalid JSON is ignored
+	}
+	for _, c := range cases {
+		w, err := spmta.NewWrapper(trkDomain, true, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := mail.Header{
+			"From": []string{"John Doe <jdoe@machine.example>"},
+			"To":   []string{"Mary Smith <mary@example.net>"},
+		}
+		for k, v := range c.hdrs {
+			h[textproto.CanonicalMIMEHeaderKey(k)] = []string{v}
+		}
+		if err = w.ProcessMessageHeaders(h); err != nil {
+			t.Error(err)
+		}
+		if (w.OpenPixel() != "") != c.expectOpen || (w.InitialOpenPixel() != "") != c.expectInitial || (w.WrapURL(link) != link) != c.expectClick {
+			t.Errorf("Headers %v gave unexpected tracking settings", c.hdrs)
+		}
+		for k := range c.hdrs {
+			if h.Get(k) != "" {
+				t.Errorf("Header %s should have been removed", k)
+			}
+		}
+	}
+}
+
+func TestMailCopyInactive(t *testing.T) {
+	var w *spmta.Wrapper // wrapping inactive
+	plain := "From: John Doe <jdoe@machine.example>\r\nTo: Mary Smith <mary@example.net>\r\nSubject: Hi\r\n\r\nHello <a href=\"https://example.com/\">there</a>\r\n"
+	var buf bytes.Buffer
+	if err := w.MailCopy(&buf, strings.NewReader(plain)); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != plain {
+		t.Errorf("Message without control headers should be copied unchanged, got %q", buf.String())
+	}
+
+	ctl := "X-Track-Opens: false\r\nX-MSYS-API: {\"options\": {\"click_tracking\": false}}\r\n" + plain
+	buf.Reset()
+	if err := w.MailCopy(&buf, strings.NewReader(ctl)); err != nil {
+		t.Fatal(err)
+	}
+	message, err := mail.ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"X-Track-Opens", "X-MSYS-API"} {
+		if message.Header.Get(k) != "" {
+			t.Errorf("Header %s should have been removed", k)
+		}
+	}
+	if message.Header.Get("Subject") != "Hi" {
+		t.Errorf("Unexpected headers %v", message.Header)
+	}
+	body, err := io.ReadAll(message.Body)
+	if err != nil || string(body) != "Hello <a href=\"https://example.com/\">there</a>\r\n" {
+		t.Errorf("Unexpected body %q %v", body, err)
+	}
+}
+
+func TestProcessMessageHeadersCampaign(t *testing.T) {
+	w, err := spmta.NewWrapper(RandomBaseURL(), true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.SetLinkParams("utm_campaign={{.Campaign}}"); err != nil {
+		t.Fatal(err)
+	}
+	h := mail.Header{
+		"From":       []string{"John Doe <jdoe@machine.example>"},
+		"To":         []string{"Mary Smith <mary@example.net>"},
+		"X-Msys-Api": []string{`{"campaign_id": "welcome_series"}`},
+	}
+	if err = w.ProcessMessageHeaders(h); err != nil {
+		t.Fatal(err)
+	}
+	_, wd, _, err := spmta.DecodeLink(w.WrapURL("https://example.com/"))
+	if err != nil || wd.TargetLinkURL != "https://example.com/?utm_campaign=welcome_series" {
+		t.Errorf("Unexpected target %s %v", wd.TargetLinkURL, err)
+	}
+}
+
 // This is the most interesting part of email wrapping, from a benchmarking / performance point of view
 func BenchmarkMailCopy(b *testing.B) {
 	wrapURL := "https://testing1234.example.com"